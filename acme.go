@@ -0,0 +1,959 @@
+package vproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const acmePrefix = "/_vproxy/acme"
+
+// How long ACME issued certs are valid for
+var acmeCertLifetime = 90 * 24 * time.Hour
+
+// Default domain suffixes which the ACME server will issue certs for
+var DefaultACMESuffixes = []string{".local", ".localhost", ".test"}
+
+// acmeServer is a minimal ACME (RFC 8555) server which issues certs signed by
+// the local CA. Challenges are accepted without validation, unless verifyAddr
+// is set, in which case an HTTP-01 check is made against the daemon itself.
+type acmeServer struct {
+	mu  sync.Mutex
+	mux *http.ServeMux
+
+	suffixes   []string
+	verifyAddr string
+
+	nonces   map[string]bool
+	accounts map[string]*acmeAccount
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	certs    map[string][]byte
+}
+
+type acmeAccount struct {
+	ID      string          `json:"id"`
+	Key     json.RawMessage `json:"key"`
+	Contact []string        `json:"contact,omitempty"`
+
+	pub crypto.PublicKey
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	id          string
+	accountID   string
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzs      []string
+	certID      string
+}
+
+type acmeAuthz struct {
+	id         string
+	accountID  string
+	status     string
+	expires    time.Time
+	identifier acmeIdentifier
+	wildcard   bool
+	token      string
+}
+
+// acmeError is an RFC 7807 problem document
+type acmeError struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (e *acmeError) Error() string {
+	return e.Detail
+}
+
+func acmeErr(status int, typ string, format string, a ...interface{}) *acmeError {
+	return &acmeError{
+		Type:   "urn:ietf:params:acme:error:" + typ,
+		Detail: fmt.Sprintf(format, a...),
+		Status: status,
+	}
+}
+
+func newACMEServer(suffixes []string) *acmeServer {
+	a := &acmeServer{
+		suffixes: normalizeSuffixes(suffixes),
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*acmeAccount),
+		orders:   make(map[string]*acmeOrder),
+		authzs:   make(map[string]*acmeAuthz),
+		certs:    make(map[string][]byte),
+	}
+	a.loadAccounts()
+
+	a.mux = http.NewServeMux()
+	a.mux.HandleFunc("GET "+acmePrefix+"/directory", a.directory)
+	a.mux.HandleFunc(acmePrefix+"/new-nonce", a.newNonce)
+	a.mux.HandleFunc("POST "+acmePrefix+"/new-account", a.newAccount)
+	a.mux.HandleFunc("POST "+acmePrefix+"/acct/{id}", a.account)
+	a.mux.HandleFunc("POST "+acmePrefix+"/acct/{id}/orders", a.accountOrders)
+	a.mux.HandleFunc("POST "+acmePrefix+"/new-order", a.newOrder)
+	a.mux.HandleFunc("POST "+acmePrefix+"/order/{id}", a.order)
+	a.mux.HandleFunc("POST "+acmePrefix+"/order/{id}/finalize", a.finalize)
+	a.mux.HandleFunc("POST "+acmePrefix+"/authz/{id}", a.authz)
+	a.mux.HandleFunc("POST "+acmePrefix+"/chall/{id}/{type}", a.challenge)
+	a.mux.HandleFunc("POST "+acmePrefix+"/cert/{id}", a.cert)
+	a.mux.HandleFunc("POST "+acmePrefix+"/revoke-cert", a.revokeCert)
+	return a
+}
+
+func (a *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", a.nonce())
+	w.Header().Set("Cache-Control", "no-store")
+	a.mux.ServeHTTP(w, r)
+}
+
+// baseURL of the ACME server, as seen by the client
+func acmeBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + acmePrefix
+}
+
+func writeACME(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", acmeBaseURL(r)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeACMEError(w http.ResponseWriter, err *acmeError) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(err)
+}
+
+func (a *acmeServer) directory(w http.ResponseWriter, r *http.Request) {
+	base := acmeBaseURL(r)
+	writeACME(w, r, http.StatusOK, map[string]interface{}{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+		"revokeCert": base + "/revoke-cert",
+		"meta": map[string]interface{}{
+			"website":                 "https://github.com/jittering/vproxy",
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (a *acmeServer) newNonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *acmeServer) nonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	n := base64.RawURLEncoding.EncodeToString(b)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.nonces) > 10000 {
+		// outstanding nonces are never used by most clients; start over
+		a.nonces = make(map[string]bool)
+	}
+	a.nonces[n] = true
+	return n
+}
+
+func (a *acmeServer) useNonce(n string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.nonces[n] {
+		return false
+	}
+	delete(a.nonces, n)
+	return true
+}
+
+func (a *acmeServer) newAccount(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, true)
+	if aerr == nil && len(req.header.JWK) == 0 {
+		aerr = acmeErr(400, "malformed", "jwk required")
+	}
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	var payload struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	json.Unmarshal(req.payload, &payload)
+
+	thumb, err := jwkThumbprint(req.header.JWK)
+	if err != nil {
+		writeACMEError(w, acmeErr(400, "badPublicKey", "%s", err))
+		return
+	}
+
+	a.mu.Lock()
+	acct := a.accounts[thumb]
+	status := http.StatusOK
+	if acct == nil {
+		if payload.OnlyReturnExisting {
+			a.mu.Unlock()
+			writeACMEError(w, acmeErr(400, "accountDoesNotExist", "no account exists for this key"))
+			return
+		}
+		acct = &acmeAccount{ID: thumb, Key: req.header.JWK, Contact: payload.Contact, pub: req.key}
+		a.accounts[thumb] = acct
+		status = http.StatusCreated
+		fmt.Printf("[*] acme: registered new account %s\n", thumb)
+	}
+	a.mu.Unlock()
+	a.saveAccounts()
+
+	w.Header().Set("Location", acmeBaseURL(r)+"/acct/"+acct.ID)
+	writeACME(w, r, status, a.accountJSON(r, acct))
+}
+
+func (a *acmeServer) account(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, false)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+	if req.account.ID != r.PathValue("id") {
+		writeACMEError(w, acmeErr(403, "unauthorized", "account mismatch"))
+		return
+	}
+	writeACME(w, r, http.StatusOK, a.accountJSON(r, req.account))
+}
+
+func (a *acmeServer) accountJSON(r *http.Request, acct *acmeAccount) map[string]interface{} {
+	return map[string]interface{}{
+		"status":  "valid",
+		"contact": acct.Contact,
+		"orders":  acmeBaseURL(r) + "/acct/" + acct.ID + "/orders",
+	}
+}
+
+func (a *acmeServer) accountOrders(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, false)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	a.mu.Lock()
+	orders := []string{}
+	for _, o := range a.orders {
+		if o.accountID == req.account.ID {
+			orders = append(orders, acmeBaseURL(r)+"/order/"+o.id)
+		}
+	}
+	a.mu.Unlock()
+	writeACME(w, r, http.StatusOK, map[string]interface{}{"orders": orders})
+}
+
+// normalizeSuffixes to lower case with a leading dot, e.g. "local" -> ".local"
+func normalizeSuffixes(suffixes []string) []string {
+	res := []string{}
+	for _, suffix := range suffixes {
+		suffix = strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+		if suffix != "" {
+			res = append(res, "."+suffix)
+		}
+	}
+	return res
+}
+
+// allowed returns true if certs may be issued for the given name, which must
+// have at least one label below one of the suffixes. Wildcards directly under
+// a suffix (e.g., *.local) are not allowed.
+func (a *acmeServer) allowed(name string) bool {
+	name = strings.TrimPrefix(strings.ToLower(name), "*.")
+	if !reHostname.MatchString(name) {
+		return false
+	}
+	for _, suffix := range a.suffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *acmeServer) newOrder(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, false)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		writeACMEError(w, acmeErr(400, "malformed", "missing identifiers"))
+		return
+	}
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			writeACMEError(w, acmeErr(400, "unsupportedIdentifier", "unsupported identifier type: %s", id.Type))
+			return
+		}
+		if !a.allowed(id.Value) {
+			writeACMEError(w, acmeErr(400, "rejectedIdentifier", "%s is not a dev domain (allowed: %s)",
+				id.Value, strings.Join(a.suffixes, ", ")))
+			return
+		}
+	}
+
+	expires := time.Now().Add(24 * time.Hour)
+	order := &acmeOrder{
+		id:          randomID(),
+		accountID:   req.account.ID,
+		status:      "pending",
+		expires:     expires,
+		identifiers: payload.Identifiers,
+	}
+
+	a.mu.Lock()
+	a.prune()
+	for _, id := range payload.Identifiers {
+		authz := &acmeAuthz{
+			id:         randomID(),
+			accountID:  req.account.ID,
+			status:     "pending",
+			expires:    expires,
+			identifier: acmeIdentifier{Type: "dns", Value: strings.TrimPrefix(id.Value, "*.")},
+			wildcard:   strings.HasPrefix(id.Value, "*."),
+			token:      randomToken(),
+		}
+		a.authzs[authz.id] = authz
+		order.authzs = append(order.authzs, authz.id)
+	}
+	a.orders[order.id] = order
+	body := a.orderJSON(r, order)
+	a.mu.Unlock()
+
+	w.Header().Set("Location", acmeBaseURL(r)+"/order/"+order.id)
+	writeACME(w, r, http.StatusCreated, body)
+}
+
+// prune expired orders, along with their authzs and cert. Must be called while
+// holding the lock.
+func (a *acmeServer) prune() {
+	now := time.Now()
+	for id, o := range a.orders {
+		if now.Before(o.expires) {
+			continue
+		}
+		for _, authzID := range o.authzs {
+			delete(a.authzs, authzID)
+		}
+		delete(a.certs, o.certID)
+		delete(a.orders, id)
+	}
+}
+
+// orderJSON renders the order. Must be called while holding the lock.
+func (a *acmeServer) orderJSON(r *http.Request, o *acmeOrder) map[string]interface{} {
+	base := acmeBaseURL(r)
+	authzs := []string{}
+	for _, id := range o.authzs {
+		authzs = append(authzs, base+"/authz/"+id)
+	}
+	res := map[string]interface{}{
+		"status":         o.status,
+		"expires":        o.expires.Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       base + "/order/" + o.id + "/finalize",
+	}
+	if o.certID != "" {
+		res["certificate"] = base + "/cert/" + o.certID
+	}
+	return res
+}
+
+// lookupOrder for the requesting account. Must be called while holding the lock.
+func (a *acmeServer) lookupOrder(id string, acct *acmeAccount) (*acmeOrder, *acmeError) {
+	o := a.orders[id]
+	if o == nil {
+		return nil, acmeErr(404, "malformed", "order not found")
+	}
+	if o.accountID != acct.ID {
+		return nil, acmeErr(403, "unauthorized", "order belongs to another account")
+	}
+	return o, nil
+}
+
+func (a *acmeServer) order(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, false)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o, aerr := a.lookupOrder(r.PathValue("id"), req.account)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+	writeACME(w, r, http.StatusOK, a.orderJSON(r, o))
+}
+
+func (a *acmeServer) authz(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, false)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	authz := a.authzs[r.PathValue("id")]
+	if authz == nil || authz.accountID != req.account.ID {
+		writeACMEError(w, acmeErr(404, "malformed", "authorization not found"))
+		return
+	}
+	writeACME(w, r, http.StatusOK, a.authzJSON(r, authz))
+}
+
+// challengeTypes offered for each authz. Only http-01 can be verified.
+func (a *acmeServer) challengeTypes() []string {
+	if a.verifyAddr != "" {
+		return []string{"http-01"}
+	}
+	return []string{"http-01", "dns-01", "tls-alpn-01"}
+}
+
+// authzJSON renders the authz. Must be called while holding the lock.
+func (a *acmeServer) authzJSON(r *http.Request, authz *acmeAuthz) map[string]interface{} {
+	challenges := []interface{}{}
+	for _, typ := range a.challengeTypes() {
+		challenges = append(challenges, a.challengeJSON(r, authz, typ))
+	}
+	res := map[string]interface{}{
+		"status":     authz.status,
+		"expires":    authz.expires.Format(time.RFC3339),
+		"identifier": authz.identifier,
+		"challenges": challenges,
+	}
+	if authz.wildcard {
+		res["wildcard"] = true
+	}
+	return res
+}
+
+func (a *acmeServer) challengeJSON(r *http.Request, authz *acmeAuthz, typ string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":   typ,
+		"url":    acmeBaseURL(r) + "/chall/" + authz.id + "/" + typ,
+		"token":  authz.token,
+		"status": authz.status,
+	}
+}
+
+func (a *acmeServer) challenge(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, false)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	a.mu.Lock()
+	authz := a.authzs[r.PathValue("id")]
+	pending := authz != nil && authz.status == "pending"
+	a.mu.Unlock()
+	if authz == nil || authz.accountID != req.account.ID {
+		writeACMEError(w, acmeErr(404, "malformed", "challenge not found"))
+		return
+	}
+
+	// empty payload is a POST-as-GET; '{}' asks us to validate
+	if len(req.payload) > 0 && pending {
+		status := "valid"
+		if a.verifyAddr != "" {
+			if err := a.verifyHTTP01(authz, req.account); err != nil {
+				fmt.Printf("[*] acme: http-01 validation failed for %s: %s\n", authz.identifier.Value, err)
+				status = "invalid"
+			}
+		}
+		a.mu.Lock()
+		authz.status = status
+		a.updateOrders()
+		a.mu.Unlock()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w.Header().Add("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"", acmeBaseURL(r), authz.id))
+	writeACME(w, r, http.StatusOK, a.challengeJSON(r, authz, r.PathValue("type")))
+}
+
+// verifyHTTP01 fetches the key authorization for the given challenge via the
+// daemon's own HTTP listener, which will route it to the vhost's upstream.
+func (a *acmeServer) verifyHTTP01(authz *acmeAuthz, acct *acmeAccount) error {
+	if authz.wildcard {
+		return fmt.Errorf("wildcard names can't be validated with http-01")
+	}
+	thumb, err := jwkThumbprint(acct.Key)
+	if err != nil {
+		return err
+	}
+	expected := authz.token + "." + thumb
+
+	u := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", a.verifyAddr, authz.token)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = authz.identifier.Value
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK || strings.TrimSpace(string(b)) != expected {
+		return fmt.Errorf("unexpected response (status %d)", res.StatusCode)
+	}
+	return nil
+}
+
+// pendingChallenge returns true if an http-01 challenge with the given token
+// is pending for the host
+func (a *acmeServer) pendingChallenge(host, token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, authz := range a.authzs {
+		if authz.status == "pending" && authz.token == token && authz.identifier.Value == host {
+			return true
+		}
+	}
+	return false
+}
+
+// updateOrders moves pending orders to ready (or invalid) once all authzs have
+// been processed. Must be called while holding the lock.
+func (a *acmeServer) updateOrders() {
+	for _, o := range a.orders {
+		if o.status != "pending" {
+			continue
+		}
+		ready := true
+		for _, id := range o.authzs {
+			switch a.authzs[id].status {
+			case "invalid":
+				o.status = "invalid"
+			case "pending":
+				ready = false
+			}
+		}
+		if ready && o.status == "pending" {
+			o.status = "ready"
+		}
+	}
+}
+
+func (a *acmeServer) finalize(w http.ResponseWriter, r *http.Request) {
+	req, aerr := a.parseRequest(r, false)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	a.mu.Lock()
+	o, aerr := a.lookupOrder(r.PathValue("id"), req.account)
+	if aerr == nil && o.status != "ready" {
+		aerr = acmeErr(403, "orderNotReady", "order is %s", o.status)
+	}
+	a.mu.Unlock()
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(req.payload, &payload)
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		writeACMEError(w, acmeErr(400, "badCSR", "failed to decode csr: %s", err))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		writeACMEError(w, acmeErr(400, "badCSR", "invalid csr: %s", err))
+		return
+	}
+
+	chain, aerr := a.issue(o, csr)
+	if aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o.certID = randomID()
+	o.status = "valid"
+	a.certs[o.certID] = chain
+
+	w.Header().Set("Location", acmeBaseURL(r)+"/order/"+o.id)
+	writeACME(w, r, http.StatusOK, a.orderJSON(r, o))
+}
+
+// issue a cert for the given CSR, which may only request names in the order
+func (a *acmeServer) issue(o *acmeOrder, csr *x509.CertificateRequest) ([]byte, *acmeError) {
+	names := map[string]bool{}
+	for _, id := range o.identifiers {
+		names[strings.ToLower(id.Value)] = true
+	}
+	requested := csr.DNSNames
+	if len(requested) == 0 && csr.Subject.CommonName != "" {
+		requested = []string{csr.Subject.CommonName}
+	}
+	if len(requested) == 0 || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return nil, acmeErr(400, "badCSR", "csr must only request dns names")
+	}
+	for _, name := range requested {
+		if !names[strings.ToLower(name)] {
+			return nil, acmeErr(400, "badCSR", "csr requests name not in order: %s", name)
+		}
+	}
+
+	tpl := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"vproxy development certificate"},
+			CommonName:   requested[0],
+		},
+		DNSNames:    requested,
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().Add(acmeCertLifetime),
+		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	chain, err := signCert(tpl, csr.PublicKey)
+	if err != nil {
+		return nil, acmeErr(500, "serverInternal", "failed to sign cert: %s", err)
+	}
+	fmt.Printf("[*] acme: issued cert for %s\n", strings.Join(requested, ", "))
+	for _, name := range requested {
+		events.publish(Event{Type: EventCertIssued, Host: name})
+	}
+	return chain, nil
+}
+
+func (a *acmeServer) cert(w http.ResponseWriter, r *http.Request) {
+	if _, aerr := a.parseRequest(r, false); aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+
+	a.mu.Lock()
+	chain := a.certs[r.PathValue("id")]
+	a.mu.Unlock()
+	if chain == nil {
+		writeACMEError(w, acmeErr(404, "malformed", "certificate not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(chain)
+}
+
+// revokeCert is accepted but otherwise ignored; we don't publish revocations
+func (a *acmeServer) revokeCert(w http.ResponseWriter, r *http.Request) {
+	// may also be signed by the cert key itself
+	if _, aerr := a.parseRequest(r, true); aerr != nil {
+		writeACMEError(w, aerr)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// acmeRequest is a verified JWS request
+type acmeRequest struct {
+	header  jwsHeader
+	payload []byte
+	key     crypto.PublicKey
+	account *acmeAccount
+}
+
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	Kid   string          `json:"kid"`
+	JWK   json.RawMessage `json:"jwk"`
+}
+
+// parseRequest verifies the JWS body of the request. It must be signed by a
+// known account, or with an embedded key when allowJWK is true.
+func (a *acmeServer) parseRequest(r *http.Request, allowJWK bool) (*acmeRequest, *acmeError) {
+	var msg struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil || json.Unmarshal(body, &msg) != nil {
+		return nil, acmeErr(400, "malformed", "invalid JWS")
+	}
+
+	req := &acmeRequest{}
+	hdr, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil || json.Unmarshal(hdr, &req.header) != nil {
+		return nil, acmeErr(400, "malformed", "invalid JWS protected header")
+	}
+	if req.payload, err = base64.RawURLEncoding.DecodeString(msg.Payload); err != nil {
+		return nil, acmeErr(400, "malformed", "invalid JWS payload")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return nil, acmeErr(400, "malformed", "invalid JWS signature")
+	}
+
+	if url := acmeBaseURL(r) + strings.TrimPrefix(r.URL.Path, acmePrefix); req.header.URL != url {
+		return nil, acmeErr(401, "unauthorized", "url mismatch: %s", req.header.URL)
+	}
+
+	if len(req.header.JWK) > 0 {
+		if !allowJWK {
+			return nil, acmeErr(400, "malformed", "kid required")
+		}
+		if req.key, err = parseJWK(req.header.JWK); err != nil {
+			return nil, acmeErr(400, "badPublicKey", "%s", err)
+		}
+	} else {
+		if req.header.Kid == "" {
+			return nil, acmeErr(400, "malformed", "kid required")
+		}
+		a.mu.Lock()
+		req.account = a.accounts[path.Base(req.header.Kid)]
+		a.mu.Unlock()
+		if req.account == nil {
+			return nil, acmeErr(400, "accountDoesNotExist", "unknown account: %s", req.header.Kid)
+		}
+		req.key = req.account.pub
+	}
+
+	if err := verifyJWS(req.header.Alg, req.key, msg.Protected+"."+msg.Payload, sig); err != nil {
+		return nil, acmeErr(400, "malformed", "bad signature: %s", err)
+	}
+
+	// only burn the nonce once we know the request is genuine
+	if !a.useNonce(req.header.Nonce) {
+		return nil, acmeErr(400, "badNonce", "invalid nonce")
+	}
+
+	return req, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, error) {
+	var k jwk
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, err
+	}
+	b64 := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+
+	switch k.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: b64(k.X), Y: b64(k.Y)}, nil
+	case "RSA":
+		return &rsa.PublicKey{N: b64(k.N), E: int(b64(k.E).Int64())}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(b), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint of the given key
+func jwkThumbprint(raw json.RawMessage) (string, error) {
+	var k jwk
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return "", err
+	}
+
+	// members must be in lexical order with no whitespace
+	var s string
+	switch k.Kty {
+	case "EC":
+		s = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	case "RSA":
+		s = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "OKP":
+		s = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	default:
+		return "", fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func verifyJWS(alg string, key crypto.PublicKey, input string, sig []byte) error {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg %s", alg)
+		}
+		sum := sha256.Sum256([]byte(input))
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig)
+
+	case "ES256", "ES384":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg %s", alg)
+		}
+		var digest []byte
+		if alg == "ES256" {
+			sum := sha256.Sum256([]byte(input))
+			digest = sum[:]
+		} else {
+			sum := sha512.Sum384([]byte(input))
+			digest = sum[:]
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("verification failed")
+		}
+		return nil
+
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg %s", alg)
+		}
+		if !ed25519.Verify(pub, []byte(input), sig) {
+			return fmt.Errorf("verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg: %s", alg)
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func acmeAccountsFile() string {
+	return filepath.Join(CertPath(), "acme-accounts.json")
+}
+
+// load saved accounts from disk so clients can reuse them across restarts
+func (a *acmeServer) loadAccounts() {
+	j, err := os.ReadFile(acmeAccountsFile())
+	if err != nil {
+		return
+	}
+	accounts := map[string]*acmeAccount{}
+	if err := json.Unmarshal(j, &accounts); err != nil {
+		fmt.Println("[*] warning: failed to load acme accounts from disk: ", err)
+		return
+	}
+	for id, acct := range accounts {
+		if acct.pub, err = parseJWK(acct.Key); err == nil {
+			a.accounts[id] = acct
+		}
+	}
+}
+
+// save accounts to disk
+func (a *acmeServer) saveAccounts() {
+	a.mu.Lock()
+	j, err := json.Marshal(a.accounts)
+	a.mu.Unlock()
+	if err == nil {
+		err = os.WriteFile(acmeAccountsFile(), j, 0600)
+	}
+	if err != nil {
+		fmt.Println("[*] warning: failed to save acme accounts to disk: ", err)
+	}
+}
@@ -0,0 +1,87 @@
+package vproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMEIssueCert(t *testing.T) {
+	a := newACMEServer(DefaultACMESuffixes)
+	server := httptest.NewServer(a)
+	defer server.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := &acme.Client{Key: key, DirectoryURL: server.URL + acmePrefix + "/directory"}
+	ctx := context.Background()
+
+	_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	assert.Nil(t, err)
+
+	// non-dev domains are rejected
+	_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+	assert.NotNil(t, err)
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("app.local"))
+	assert.Nil(t, err)
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		assert.Nil(t, err)
+		_, err = client.Accept(ctx, z.Challenges[0])
+		assert.Nil(t, err)
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	assert.Nil(t, err)
+	assert.Equal(t, acme.StatusReady, order.Status)
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"app.local"}}, certKey)
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(der))
+
+	cert, err := x509.ParseCertificate(der[0])
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app.local"}, cert.DNSNames)
+	ca, err := loadCACert()
+	assert.Nil(t, err)
+	assert.Nil(t, cert.CheckSignatureFrom(ca))
+
+	dir, err := client.Discover(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "", dir.KeyChangeURL)
+
+	// expired orders are dropped along with their authzs and certs
+	a.mu.Lock()
+	for _, o := range a.orders {
+		o.expires = time.Now().Add(-time.Second)
+	}
+	a.prune()
+	assert.Equal(t, 0, len(a.orders))
+	assert.Equal(t, 0, len(a.authzs))
+	assert.Equal(t, 0, len(a.certs))
+	a.mu.Unlock()
+}
+
+func TestACMEAllowed(t *testing.T) {
+	a := newACMEServer([]string{"local", ".Test", " "})
+	assert.Equal(t, []string{".local", ".test"}, a.suffixes)
+
+	for _, name := range []string{"app.local", "APP.Local", "a.b.test", "*.app.local"} {
+		assert.True(t, a.allowed(name), name)
+	}
+	for _, name := range []string{"local", ".local", "*.local", "*.test", "a..local", "app.local.", "*.*.app.local", "foo.internal", "example.com"} {
+		assert.False(t, a.allowed(name), name)
+	}
+
+	// .internal is a real private-use TLD
+	assert.False(t, newACMEServer(DefaultACMESuffixes).allowed("app.internal"))
+}
@@ -24,6 +24,57 @@ type Config struct {
 
 		CaRootPath string `toml:"caroot_path"`
 		CertPath   string `toml:"cert_path"`
+
+		ACME         bool     `toml:"acme"`
+		ACMESuffixes []string `toml:"acme_suffixes"`
+		ACMEVerify   bool     `toml:"acme_verify"`
+
+		TLSMinVersion string   `toml:"tls_min_version"`
+		TLSMaxVersion string   `toml:"tls_max_version"`
+		TLSCiphers    []string `toml:"tls_ciphers"`
+		TLSCurves     []string `toml:"tls_curves"`
+		HTTP2         *bool    `toml:"http2"`
+
+		RedirectHTTPS bool `toml:"redirect_https"`
+		HSTS          bool `toml:"hsts"`
+		HSTSMaxAge    int  `toml:"hsts_max_age"`
+
+		OTLPEndpoint string   `toml:"otlp_endpoint"`
+		Dashboard    *bool    `toml:"dashboard"`
+		Webhooks     []string `toml:"webhooks"`
+		TCPPorts     string   `toml:"tcp_ports"`
+
+		LogFormat   string `toml:"log_format"`
+		LogHistory  int    `toml:"log_history"`
+		LogFiles    bool   `toml:"log_files"`
+		LogMaxSize  int    `toml:"log_max_size"`
+		LogMaxFiles int    `toml:"log_max_files"`
+
+		RetryTimeout     string   `toml:"retry_timeout"`
+		RetryMaxAttempts int      `toml:"retry_max_attempts"`
+		RetryMethods     []string `toml:"retry_methods"`
+		RetryOn          []string `toml:"retry_on"`
+		RetryBodyLimit   int      `toml:"retry_body_limit"`
+
+		RequestHeaders   []string `toml:"request_headers"`
+		ResponseHeaders  []string `toml:"response_headers"`
+		RewriteResponses *bool    `toml:"rewrite_responses"`
+		ErrorPages       string   `toml:"error_pages"`
+
+		Compress          *bool    `toml:"compress"`
+		CompressEncodings []string `toml:"compress_encodings"`
+		CompressTypes     []string `toml:"compress_types"`
+		CompressMinSize   int      `toml:"compress_min_size"`
+		NoCache           *bool    `toml:"no_cache"`
+
+		ForwardedMode  string   `toml:"forwarded_mode"`
+		TrustedProxies []string `toml:"trusted_proxies"`
+
+		HealthCheck        *bool  `toml:"health_check"`
+		HealthPath         string `toml:"health_path"`
+		HealthInterval     string `toml:"health_interval"`
+		HealthyThreshold   int    `toml:"healthy_threshold"`
+		UnhealthyThreshold int    `toml:"unhealthy_threshold"`
 	}
 
 	Client struct {
@@ -32,6 +83,8 @@ type Config struct {
 		Host string
 		HTTP int
 		Bind string
+
+		LogFormat string `toml:"log_format"`
 	}
 }
 
@@ -84,6 +137,12 @@ func loadConfigFile(path string) (*Config, error) {
 	return &conf, nil
 }
 
+// isDaemon returns true when running the daemon command. Used for settings
+// which share a flag name with the connect command.
+func isDaemon(c *cli.Context) bool {
+	return c.Command != nil && c.Command.Name == "daemon"
+}
+
 // transform listen addr arg
 func cleanListenAddr(c *cli.Context) {
 	listen := c.String("listen")
@@ -147,6 +206,174 @@ func loadConfig(c *cli.Context, conf string) error {
 			os.Setenv("CERT_PATH", v)
 			verbose(c, "via conf: CERT_PATH=%s", v)
 		}
+		if v := config.Server.ACME; v && !c.IsSet("acme") {
+			verbose(c, "via conf: acme=true")
+			c.Set("acme", "true")
+		}
+		if v := config.Server.ACMESuffixes; len(v) > 0 && !c.IsSet("acme-suffix") {
+			verbose(c, "via conf: acme_suffixes=%s", strings.Join(v, ","))
+			c.Set("acme-suffix", strings.Join(v, ","))
+		}
+		if v := config.Server.ACMEVerify; v && !c.IsSet("acme-verify") {
+			verbose(c, "via conf: acme_verify=true")
+			c.Set("acme-verify", "true")
+		}
+		if v := config.Server.TLSMinVersion; v != "" && isDaemon(c) && !c.IsSet("tls-min") {
+			verbose(c, "via conf: tls_min_version=%s", v)
+			c.Set("tls-min", v)
+		}
+		if v := config.Server.TLSMaxVersion; v != "" && isDaemon(c) && !c.IsSet("tls-max") {
+			verbose(c, "via conf: tls_max_version=%s", v)
+			c.Set("tls-max", v)
+		}
+		if v := config.Server.TLSCiphers; len(v) > 0 && isDaemon(c) && !c.IsSet("tls-cipher") {
+			verbose(c, "via conf: tls_ciphers=%s", strings.Join(v, ","))
+			c.Set("tls-cipher", strings.Join(v, ","))
+		}
+		if v := config.Server.TLSCurves; len(v) > 0 && isDaemon(c) && !c.IsSet("tls-curve") {
+			verbose(c, "via conf: tls_curves=%s", strings.Join(v, ","))
+			c.Set("tls-curve", strings.Join(v, ","))
+		}
+		if v := config.Server.HTTP2; v != nil && isDaemon(c) && !c.IsSet("http2") {
+			verbose(c, "via conf: http2=%t", *v)
+			c.Set("http2", strconv.FormatBool(*v))
+		}
+		if v := config.Server.OTLPEndpoint; v != "" && !c.IsSet("otlp-endpoint") {
+			verbose(c, "via conf: otlp_endpoint=%s", v)
+			c.Set("otlp-endpoint", v)
+		}
+		if v := config.Server.Dashboard; v != nil && isDaemon(c) && !c.IsSet("dashboard") {
+			verbose(c, "via conf: dashboard=%t", *v)
+			c.Set("dashboard", strconv.FormatBool(*v))
+		}
+		if v := config.Server.Webhooks; len(v) > 0 && isDaemon(c) && !c.IsSet("webhook") {
+			verbose(c, "via conf: webhooks=%s", strings.Join(v, ","))
+			c.Set("webhook", strings.Join(v, ","))
+		}
+		if v := config.Server.TCPPorts; v != "" && isDaemon(c) && !c.IsSet("tcp-ports") {
+			verbose(c, "via conf: tcp_ports=%s", v)
+			c.Set("tcp-ports", v)
+		}
+		if v := config.Server.LogFormat; v != "" && !c.IsSet("log-format") {
+			verbose(c, "via conf: log_format=%s", v)
+			c.Set("log-format", v)
+		}
+		if v := config.Server.RedirectHTTPS; v && isDaemon(c) && !c.IsSet("redirect-https") {
+			verbose(c, "via conf: redirect_https=true")
+			c.Set("redirect-https", "true")
+		}
+		if v := config.Server.HSTS; v && isDaemon(c) && !c.IsSet("hsts") {
+			verbose(c, "via conf: hsts=true")
+			c.Set("hsts", "true")
+		}
+		if v := config.Server.HSTSMaxAge; v > 0 && isDaemon(c) && !c.IsSet("hsts-max-age") {
+			verbose(c, "via conf: hsts_max_age=%d", v)
+			c.Set("hsts-max-age", strconv.Itoa(v))
+		}
+		if v := config.Server.LogHistory; v > 0 && isDaemon(c) && !c.IsSet("log-history") {
+			verbose(c, "via conf: log_history=%d", v)
+			c.Set("log-history", strconv.Itoa(v))
+		}
+		if v := config.Server.LogFiles; v && isDaemon(c) && !c.IsSet("log-files") {
+			verbose(c, "via conf: log_files=true")
+			c.Set("log-files", "true")
+		}
+		if v := config.Server.LogMaxSize; v > 0 && isDaemon(c) && !c.IsSet("log-max-size") {
+			verbose(c, "via conf: log_max_size=%d", v)
+			c.Set("log-max-size", strconv.Itoa(v))
+		}
+		if v := config.Server.LogMaxFiles; v > 0 && isDaemon(c) && !c.IsSet("log-max-files") {
+			verbose(c, "via conf: log_max_files=%d", v)
+			c.Set("log-max-files", strconv.Itoa(v))
+		}
+		if v := config.Server.RetryTimeout; v != "" && isDaemon(c) && !c.IsSet("retry-timeout") {
+			verbose(c, "via conf: retry_timeout=%s", v)
+			c.Set("retry-timeout", v)
+		}
+		if v := config.Server.RetryMaxAttempts; v > 0 && isDaemon(c) && !c.IsSet("retry-max-attempts") {
+			verbose(c, "via conf: retry_max_attempts=%d", v)
+			c.Set("retry-max-attempts", strconv.Itoa(v))
+		}
+		if v := config.Server.RetryMethods; len(v) > 0 && isDaemon(c) && !c.IsSet("retry-method") {
+			verbose(c, "via conf: retry_methods=%s", strings.Join(v, ","))
+			c.Set("retry-method", strings.Join(v, ","))
+		}
+		if v := config.Server.RetryOn; len(v) > 0 && isDaemon(c) && !c.IsSet("retry-on") {
+			verbose(c, "via conf: retry_on=%s", strings.Join(v, ","))
+			c.Set("retry-on", strings.Join(v, ","))
+		}
+		if v := config.Server.RetryBodyLimit; v > 0 && isDaemon(c) && !c.IsSet("retry-body-limit") {
+			verbose(c, "via conf: retry_body_limit=%d", v)
+			c.Set("retry-body-limit", strconv.Itoa(v))
+		}
+		if v := config.Server.RequestHeaders; len(v) > 0 && isDaemon(c) && !c.IsSet("request-header") {
+			verbose(c, "via conf: request_headers=%s", strings.Join(v, "; "))
+			for _, h := range v {
+				c.Set("request-header", h)
+			}
+		}
+		if v := config.Server.ResponseHeaders; len(v) > 0 && isDaemon(c) && !c.IsSet("response-header") {
+			verbose(c, "via conf: response_headers=%s", strings.Join(v, "; "))
+			for _, h := range v {
+				c.Set("response-header", h)
+			}
+		}
+		if v := config.Server.RewriteResponses; v != nil && isDaemon(c) && !c.IsSet("rewrite-responses") {
+			verbose(c, "via conf: rewrite_responses=%t", *v)
+			c.Set("rewrite-responses", strconv.FormatBool(*v))
+		}
+		if v := config.Server.ErrorPages; v != "" && isDaemon(c) && !c.IsSet("error-pages") {
+			verbose(c, "via conf: error_pages=%s", v)
+			c.Set("error-pages", v)
+		}
+		if v := config.Server.Compress; v != nil && isDaemon(c) && !c.IsSet("compress") {
+			verbose(c, "via conf: compress=%t", *v)
+			c.Set("compress", strconv.FormatBool(*v))
+		}
+		if v := config.Server.CompressEncodings; len(v) > 0 && isDaemon(c) && !c.IsSet("compress-encoding") {
+			verbose(c, "via conf: compress_encodings=%s", strings.Join(v, ","))
+			c.Set("compress-encoding", strings.Join(v, ","))
+		}
+		if v := config.Server.CompressTypes; len(v) > 0 && isDaemon(c) && !c.IsSet("compress-type") {
+			verbose(c, "via conf: compress_types=%s", strings.Join(v, ","))
+			c.Set("compress-type", strings.Join(v, ","))
+		}
+		if v := config.Server.CompressMinSize; v > 0 && isDaemon(c) && !c.IsSet("compress-min-size") {
+			verbose(c, "via conf: compress_min_size=%d", v)
+			c.Set("compress-min-size", strconv.Itoa(v))
+		}
+		if v := config.Server.NoCache; v != nil && isDaemon(c) && !c.IsSet("no-cache") {
+			verbose(c, "via conf: no_cache=%t", *v)
+			c.Set("no-cache", strconv.FormatBool(*v))
+		}
+		if v := config.Server.ForwardedMode; v != "" && isDaemon(c) && !c.IsSet("forwarded-mode") {
+			verbose(c, "via conf: forwarded_mode=%s", v)
+			c.Set("forwarded-mode", v)
+		}
+		if v := config.Server.TrustedProxies; len(v) > 0 && isDaemon(c) && !c.IsSet("trusted-proxy") {
+			verbose(c, "via conf: trusted_proxies=%s", strings.Join(v, ","))
+			c.Set("trusted-proxy", strings.Join(v, ","))
+		}
+		if v := config.Server.HealthCheck; v != nil && isDaemon(c) && !c.IsSet("health-check") {
+			verbose(c, "via conf: health_check=%t", *v)
+			c.Set("health-check", strconv.FormatBool(*v))
+		}
+		if v := config.Server.HealthPath; v != "" && isDaemon(c) && !c.IsSet("health-path") {
+			verbose(c, "via conf: health_path=%s", v)
+			c.Set("health-path", v)
+		}
+		if v := config.Server.HealthInterval; v != "" && isDaemon(c) && !c.IsSet("health-interval") {
+			verbose(c, "via conf: health_interval=%s", v)
+			c.Set("health-interval", v)
+		}
+		if v := config.Server.HealthyThreshold; v > 0 && isDaemon(c) && !c.IsSet("healthy-threshold") {
+			verbose(c, "via conf: healthy_threshold=%d", v)
+			c.Set("healthy-threshold", strconv.Itoa(v))
+		}
+		if v := config.Server.UnhealthyThreshold; v > 0 && isDaemon(c) && !c.IsSet("unhealthy-threshold") {
+			verbose(c, "via conf: unhealthy_threshold=%d", v)
+			c.Set("unhealthy-threshold", strconv.Itoa(v))
+		}
 
 		// client configs
 		if v := (config.Client.Verbose || config.Verbose); v && !c.IsSet("verbose") {
@@ -166,6 +393,10 @@ func loadConfig(c *cli.Context, conf string) error {
 			verbose(c, "via conf: bind=%s", v)
 			c.Set("bind", v)
 		}
+		if v := config.Client.LogFormat; v != "" && !c.IsSet("format") {
+			verbose(c, "via conf: log_format=%s", v)
+			c.Set("format", v)
+		}
 		if v := config.Server.CaRootPath; v != "" {
 			os.Setenv("CAROOT_PATH", v)
 			verbose(c, "via conf: CAROOT_PATH=%s", v)
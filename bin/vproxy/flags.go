@@ -20,6 +20,7 @@ func parseFlags() {
 	if date == "" {
 		date = "n/a"
 	}
+	vproxy.Version = version
 
 	cli.VersionFlag = &cli.BoolFlag{
 		Name:    "version",
@@ -79,7 +80,7 @@ vproxy connect hello.local:8888 -- vproxy hello
 				Usage:   "Run host daemon",
 				Action:  startDaemon,
 				Before:  loadDaemonConfig,
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "listen",
 						Aliases: []string{"l"},
@@ -96,7 +97,43 @@ vproxy connect hello.local:8888 -- vproxy hello
 						Value: 443,
 						Usage: "Port to listen for HTTP (0 to disable)",
 					},
-				},
+					&cli.StringFlag{
+						Name:  "log-format",
+						Value: vproxy.LogFormatText,
+						Usage: "Access log format: " + strings.Join(vproxy.LogFormats, ", "),
+					},
+					&cli.BoolFlag{
+						Name:  "acme",
+						Usage: "Serve an ACME directory at /_vproxy/acme/directory for issuing certs from the local CA",
+					},
+					&cli.StringSliceFlag{
+						Name:  "acme-suffix",
+						Value: cli.NewStringSlice(vproxy.DefaultACMESuffixes...),
+						Usage: "Domain suffixes which ACME clients may request certs for",
+					},
+					&cli.BoolFlag{
+						Name:  "acme-verify",
+						Usage: "Validate ACME http-01 challenges via the daemon instead of accepting them as-is",
+					},
+					&cli.StringFlag{
+						Name:  "otlp-endpoint",
+						Usage: "Export a span per request to an OTLP/HTTP collector `URL` (e.g., http://127.0.0.1:4318)",
+					},
+					&cli.BoolFlag{
+						Name:  "dashboard",
+						Value: true,
+						Usage: "Serve a web dashboard at https://vproxy.local (--dashboard=false to disable)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "webhook",
+						Usage: "POST daemon events (vhost added/removed, upstream errors, etc.) as JSON to `URL` (repeatable)",
+					},
+					&cli.StringFlag{
+						Name:  "tcp-ports",
+						Value: "20000-20999",
+						Usage: "Port `RANGE` for TCP vhosts connected with --tcp auto",
+					},
+				}, vhostOptionFlags()...),
 			},
 			{
 				Name:    "connect",
@@ -104,7 +141,10 @@ vproxy connect hello.local:8888 -- vproxy hello
 				Usage:   "Add a new vhost",
 				Action:  connectVhost,
 				Before:  loadClientConfig,
-				Flags: []cli.Flag{
+				UsageText: `vproxy connect [command options] <hostname:port> [-- command...]
+
+Flags must come before the hostname; anything after it is the command to run.`,
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "host",
 						Value: "127.0.0.1",
@@ -136,7 +176,64 @@ vproxy connect hello.local:8888 -- vproxy hello
 						Name:  "detach",
 						Usage: "Do not stream logs after binding",
 					},
-				},
+					logFormatFlag(),
+					&cli.StringFlag{
+						Name:  "client-auth",
+						Usage: "Enable mTLS: 'optional' or 'require' a client cert",
+					},
+					&cli.StringFlag{
+						Name:  "client-ca",
+						Usage: "PEM `FILE` with CA(s) trusted to sign client certs (default: local CA)",
+					},
+					&cli.BoolFlag{
+						Name:  "capture",
+						Usage: "Capture full requests and responses for `vproxy inspect`",
+					},
+					&cli.IntFlag{
+						Name:  "capture-size",
+						Usage: "Number of requests to keep when capturing (default: 100)",
+					},
+					&cli.IntFlag{
+						Name:  "capture-body-limit",
+						Usage: "Max `BYTES` to keep per request/response body when capturing (default: 1MB)",
+					},
+					&cli.StringFlag{
+						Name:  "har-file",
+						Usage: "Continuously append requests to a HAR file `NAME` in ~/.vproxy/har (or NDJSON, if named *.ndjson)",
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Serve files from `DIR` instead of proxying to a local port (bind a hostname only)",
+					},
+					&cli.BoolFlag{
+						Name:  "spa",
+						Usage: "Serve index.html for unknown paths, for single-page apps (with --dir)",
+					},
+					&cli.BoolFlag{
+						Name:  "dir-listing",
+						Usage: "List directories without an index.html (with --dir, default: true)",
+					},
+					&cli.StringFlag{
+						Name:  "redirect",
+						Usage: "Redirect all requests to `URL`, preserving the path and query (bind a hostname only)",
+					},
+					&cli.IntFlag{
+						Name:  "redirect-code",
+						Usage: "Redirect status: 301, 302, 307 or 308 (with --redirect, default: 302)",
+					},
+					&cli.StringFlag{
+						Name:  "alias-of",
+						Usage: "Serve requests with the vhost for `HOST`, sharing its cert (bind a hostname only)",
+					},
+					&cli.StringFlag{
+						Name:  "tcp",
+						Usage: "Forward raw TCP from `PORT` (or a range, e.g. 7000-7002, or 'auto') to the bound port instead of HTTP",
+					},
+					&cli.BoolFlag{
+						Name:  "tcp-tls",
+						Usage: "Terminate TLS on the --tcp port using the vhost's cert",
+					},
+				}, append(vhostOptionFlags(), logFilterFlags()...)...),
 			},
 			{
 				Name:      "disconnect",
@@ -169,7 +266,7 @@ vproxy connect hello.local:8888 -- vproxy hello
 				Action:    tailLogs,
 				Before:    loadClientConfig,
 				UsageText: `vproxy tail [command options] <hostname>`,
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "host",
 						Value: "127.0.0.1",
@@ -184,7 +281,66 @@ vproxy connect hello.local:8888 -- vproxy hello
 						Name:  "no-follow",
 						Usage: "Get the most recent logs and exit",
 					},
-				},
+					&cli.DurationFlag{
+						Name:  "since",
+						Usage: "Show logs from the last `DURATION` (e.g., 1h), including on-disk logs",
+					},
+					logFormatFlag(),
+				}, logFilterFlags()...),
+			},
+			{
+				Name:      "inspect",
+				Usage:     "List captured requests for a vhost, or show a single request",
+				Action:    inspectRequests,
+				Before:    loadClientConfig,
+				UsageText: `vproxy inspect [command options] <hostname> [id]`,
+				Flags: append(daemonFlags(),
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output as JSON",
+					},
+				),
+			},
+			{
+				Name:      "har",
+				Usage:     "Export recent requests for a vhost in HAR format",
+				Action:    exportHAR,
+				Before:    loadClientConfig,
+				UsageText: `vproxy har [command options] <hostname> > out.har`,
+				Flags: append(daemonFlags(),
+					&cli.DurationFlag{
+						Name:  "since",
+						Usage: "Only export requests from the last `DURATION` (e.g., 10m)",
+					},
+				),
+			},
+			{
+				Name:      "replay",
+				Usage:     "Re-send a recent request to the vhost's upstream",
+				Action:    replayRequest,
+				Before:    loadClientConfig,
+				UsageText: `vproxy replay [command options] <hostname> <id>`,
+				Flags: append(daemonFlags(),
+					&cli.BoolFlag{
+						Name:  "edit",
+						Usage: "Edit the request in $EDITOR before sending",
+					},
+					&cli.GenericFlag{
+						Name:    "header",
+						Aliases: []string{"H"},
+						Value:   &headerList{},
+						Usage:   "Set a request header (`\"Name: value\"`); an empty value removes it",
+					},
+					&cli.StringFlag{
+						Name:    "data",
+						Aliases: []string{"d"},
+						Usage:   "Replace the request body (`DATA` or @file)",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output as JSON",
+					},
+				),
 			},
 			{
 				Name:    "list",
@@ -205,6 +361,40 @@ vproxy connect hello.local:8888 -- vproxy hello
 					},
 				},
 			},
+			{
+				Name:  "certs",
+				Usage: "Manage vhost certificates",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List certs with their expiry and status",
+						Action: listCerts,
+						Before: loadClientConfig,
+						Flags:  daemonFlags(),
+					},
+					{
+						Name:   "prune",
+						Usage:  "Remove certs for hosts which are no longer registered",
+						Action: pruneCerts,
+						Before: loadClientConfig,
+						Flags:  daemonFlags(),
+					},
+					{
+						Name:      "client",
+						Usage:     "Issue a client cert (for mTLS) from the local CA",
+						UsageText: `vproxy certs client [command options] <name>`,
+						Action:    makeClientCert,
+						Before:    loadClientConfig,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "out",
+								Value: ".",
+								Usage: "Directory to write the cert and key to",
+							},
+						},
+					},
+				},
+			},
 			{
 				Name:   "caroot",
 				Usage:  "Print CAROOT path and exit",
@@ -316,3 +506,215 @@ func shouldHideFlags() bool {
 	}
 	return true
 }
+
+// Common flags for commands which talk to the daemon
+func daemonFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "host",
+			Value: "127.0.0.1",
+			Usage: "Daemon host IP",
+		},
+		&cli.IntFlag{
+			Name:  "http",
+			Value: 80,
+			Usage: "Daemon HTTP port",
+		},
+	}
+}
+
+// Vhost option flags, for the daemon (defaults) and connect (per-vhost)
+func vhostOptionFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "tls-min",
+			Usage: "Minimum TLS `VERSION` (1.0, 1.1, 1.2, 1.3)",
+		},
+		&cli.StringFlag{
+			Name:  "tls-max",
+			Usage: "Maximum TLS `VERSION` (1.0, 1.1, 1.2, 1.3)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tls-cipher",
+			Usage: "Allowed TLS 1.0-1.2 cipher suite(s), e.g., TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tls-curve",
+			Usage: "Curve preference(s): X25519, P256, P384, P521",
+		},
+		&cli.BoolFlag{
+			Name:  "http2",
+			Value: true,
+			Usage: "Offer HTTP/2 via ALPN (--http2=false for HTTP/1.1 only)",
+		},
+		&cli.BoolFlag{
+			Name:  "redirect-https",
+			Usage: "Redirect HTTP requests to HTTPS (308)",
+		},
+		&cli.BoolFlag{
+			Name:  "hsts",
+			Usage: "Send Strict-Transport-Security header on HTTPS responses",
+		},
+		&cli.IntFlag{
+			Name:  "hsts-max-age",
+			Usage: "HSTS max-age in `SECONDS` (default: 3600)",
+		},
+		&cli.IntFlag{
+			Name:  "log-history",
+			Usage: "Number of log lines kept in memory per vhost (default: 100)",
+		},
+		&cli.BoolFlag{
+			Name:  "log-files",
+			Usage: "Write access logs to rotating files under CERT_PATH/logs",
+		},
+		&cli.IntFlag{
+			Name:  "log-max-size",
+			Usage: "Max log file size in `MB` before rotating (default: 10)",
+		},
+		&cli.IntFlag{
+			Name:  "log-max-files",
+			Usage: "Number of rotated log files to keep (default: 5)",
+		},
+		&cli.DurationFlag{
+			Name:  "retry-timeout",
+			Usage: "Max time spent retrying a failed upstream request (default: 30s)",
+		},
+		&cli.IntFlag{
+			Name:  "retry-max-attempts",
+			Usage: "Max attempts per upstream request, including the first (default: unlimited, 1 disables retries)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "retry-method",
+			Usage: "Methods which may be resent after reaching the upstream (default: GET, HEAD, OPTIONS, TRACE, PUT, DELETE)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "retry-on",
+			Usage: "Retry on: " + strings.Join(vproxy.RetryConditions, ", ") + " (default: connect)",
+		},
+		&cli.IntFlag{
+			Name:  "retry-body-limit",
+			Usage: "Max request body `BYTES` buffered so the request can be resent (default: 1MB)",
+		},
+		&cli.GenericFlag{
+			Name:  "request-header",
+			Value: &headerList{},
+			Usage: "Header rule for requests sent upstream: `\"Name: value\"` (set), \"+Name: value\" (add) or \"-Name\" (remove); values may use {host}, {remote_addr} and {request_id}",
+		},
+		&cli.GenericFlag{
+			Name:  "response-header",
+			Value: &headerList{},
+			Usage: "Header rule for responses, e.g. `\"Cache-Control: no-store\"` (same syntax as --request-header)",
+		},
+		&cli.BoolFlag{
+			Name:  "rewrite-responses",
+			Usage: "Rewrite upstream URLs in redirects and cookie domains to the vhost (default: true)",
+		},
+		&cli.StringFlag{
+			Name:  "error-pages",
+			Usage: "`DIR` of error page templates: unknown_host.html, upstream_down.html, upstream_timeout.html, panic.html or error.html",
+		},
+		&cli.BoolFlag{
+			Name:  "compress",
+			Usage: "Compress responses with the best encoding accepted by the client",
+		},
+		&cli.StringSliceFlag{
+			Name:  "compress-encoding",
+			Usage: "Encodings to use, in order of preference: " + strings.Join(vproxy.Encodings, ", ") + " (default: all)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "compress-type",
+			Usage: "Content `TYPE` to compress, e.g. text/* (default: text, JSON, JavaScript, XML, SVG and WASM)",
+		},
+		&cli.IntFlag{
+			Name:  "compress-min-size",
+			Usage: "Min response `BYTES` to compress (default: 1024)",
+		},
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "Strip caching headers so that browsers never use stale responses",
+		},
+		&cli.StringFlag{
+			Name:  "forwarded-mode",
+			Usage: "Forwarded headers sent by clients: \"overwrite\" them, or \"append\" to them from trusted proxies (default: overwrite)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "trusted-proxy",
+			Usage: "Client IP or `CIDR` whose forwarded headers are appended to (default: 127.0.0.0/8, ::1)",
+		},
+		&cli.BoolFlag{
+			Name:  "health-check",
+			Usage: "Check upstream health in the background (default: only with --health-path)",
+		},
+		&cli.StringFlag{
+			Name:  "health-path",
+			Usage: "Check health via HTTP GET of `PATH` instead of a TCP connect",
+		},
+		&cli.DurationFlag{
+			Name:  "health-interval",
+			Usage: "Time between health checks (default: 5s)",
+		},
+		&cli.IntFlag{
+			Name:  "healthy-threshold",
+			Usage: "Consecutive successful checks before an upstream is marked up (default: 1)",
+		},
+		&cli.IntFlag{
+			Name:  "unhealthy-threshold",
+			Usage: "Consecutive failed checks before an upstream is marked down (default: 2)",
+		},
+	}
+}
+
+// Log filter flags for commands which stream logs
+func logFilterFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "status",
+			Usage: "Only show responses with the given status code or class (e.g., 5xx, 404)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "method",
+			Usage: "Only show requests with the given method(s)",
+		},
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "Only show paths matching a glob (/api/**) or regex prefixed with ~ (~^/api/v[12]/)",
+		},
+		&cli.DurationFlag{
+			Name:  "min-duration",
+			Usage: "Only show requests which took at least `DURATION` (e.g., 500ms)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-ext",
+			Usage: "Hide requests for paths with the given extension(s) (e.g., js,css,png)",
+		},
+	}
+}
+
+// Log format flag for commands which stream logs
+func logFormatFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "format",
+		Value: vproxy.LogFormatText,
+		Usage: "Log format: " + strings.Join(vproxy.LogFormats, ", "),
+	}
+}
+
+// headerList is a repeatable flag which, unlike StringSliceFlag, does not split
+// values on commas (common in header values)
+type headerList []string
+
+func (h *headerList) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+func (h *headerList) String() string {
+	return strings.Join(*h, "; ")
+}
+
+func headerRules(c *cli.Context, name string) []string {
+	if h, ok := c.Generic(name).(*headerList); ok && len(*h) > 0 {
+		return *h
+	}
+	return nil
+}
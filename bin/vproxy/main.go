@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -27,6 +28,7 @@ var listenDefaultAddr = "127.0.0.1"
 var listenAnyIP = "0.0.0.0"
 
 var reBinding = regexp.MustCompile("^.*?:[0-9]+$")
+var reHostname = regexp.MustCompile("^[a-zA-Z0-9.-]+$")
 
 func verbose(c *cli.Context, a ...interface{}) {
 	if c.IsSet("verbose") {
@@ -46,7 +48,7 @@ func connectVhost(c *cli.Context) error {
 	if len(binds) == 0 {
 		// see if one was passed as the first arg
 		if c.Args().Present() {
-			if b := c.Args().First(); b != "" && validateBinding(b) == nil {
+			if b := c.Args().First(); b != "" && (validateBinding(b) == nil || reHostname.MatchString(b)) {
 				binds = append(binds, b)
 			} else {
 				return fmt.Errorf("must bind at least one hostname")
@@ -60,13 +62,48 @@ func connectVhost(c *cli.Context) error {
 			return fmt.Errorf("must bind at least one hostname")
 		}
 	}
+	noUpstream := c.String("dir") != "" || c.String("redirect") != "" || c.String("alias-of") != ""
+	if noUpstream && len(args) > 0 {
+		return fmt.Errorf("unexpected command '%s' (there is no upstream with --dir, --redirect or --alias-of; flags must come before the hostname)", strings.Join(args, " "))
+	}
 	for _, bind := range binds {
-		if err := validateBinding(bind); err != nil {
+		if noUpstream {
+			if !reHostname.MatchString(bind) {
+				return fmt.Errorf("invalid binding: '%s' (expected a hostname with --dir, --redirect or --alias-of, e.g., 'docs.local.com')", bind)
+			}
+		} else if err := validateBinding(bind); err != nil {
+			if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+				return fmt.Errorf("%s; flags must come before the hostname", err)
+			}
 			return err
 		}
 	}
 
 	client := createClient(c)
+	if err := vproxy.ValidateLogFormat(c.String("format")); err != nil {
+		return err
+	}
+
+	client.Options = vhostOptions(c)
+	client.Options.ClientAuth = c.String("client-auth")
+	client.Options.ClientCA = absPath(c.String("client-ca"))
+	client.Options.Dir = absPath(c.String("dir"))
+	client.Options.SPA = boolFlag(c, "spa")
+	client.Options.DirListing = boolFlag(c, "dir-listing")
+	client.Options.Redirect = c.String("redirect")
+	client.Options.RedirectCode = c.Int("redirect-code")
+	client.Options.AliasOf = c.String("alias-of")
+	client.Options.TCP = c.String("tcp")
+	client.Options.TCPTLS = boolFlag(c, "tcp-tls")
+	if err := client.Options.Validate(); err != nil {
+		return err
+	}
+	filter, err := logFilter(c)
+	if err != nil {
+		return err
+	}
+	client.LogFilter = filter
+
 	if !client.IsDaemonRunning() {
 		fmt.Println("[*] warning: daemon not running on localhost. running in single-client mode")
 
@@ -111,7 +148,19 @@ func disconnectVhost(c *cli.Context) error {
 func createClient(c *cli.Context) *vproxy.Client {
 	host := c.String("host")
 	httpPort := c.Int("http")
-	return &vproxy.Client{Addr: fmt.Sprintf("%s:%d", host, httpPort)}
+	return &vproxy.Client{Addr: fmt.Sprintf("%s:%d", host, httpPort), LogFormat: c.String("format")}
+}
+
+// logFilter from flags, validated so errors are reported before connecting
+func logFilter(c *cli.Context) (vproxy.LogFilter, error) {
+	filter := vproxy.LogFilter{
+		Status:      c.StringSlice("status"),
+		Methods:     c.StringSlice("method"),
+		Path:        c.String("path"),
+		MinDuration: c.Duration("min-duration"),
+		ExcludeExt:  c.StringSlice("exclude-ext"),
+	}
+	return filter, filter.Validate()
 }
 
 func tailLogs(c *cli.Context) error {
@@ -119,13 +168,237 @@ func tailLogs(c *cli.Context) error {
 		return fmt.Errorf("missing hostname")
 	}
 
+	if err := vproxy.ValidateLogFormat(c.String("format")); err != nil {
+		return err
+	}
+
+	filter, err := logFilter(c)
+	if err != nil {
+		return err
+	}
+
 	hostname := c.Args().First()
 	client := createClient(c)
+	client.LogFilter = filter
+	client.TailSince = c.Duration("since")
 	client.Tail(hostname, !c.Bool("no-follow"))
 
 	return nil
 }
 
+func listCerts(c *cli.Context) error {
+	createClient(c).ListCerts()
+	return nil
+}
+
+func pruneCerts(c *cli.Context) error {
+	createClient(c).PruneCerts()
+	return nil
+}
+
+func makeClientCert(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if os.Getenv("CAROOT_PATH") != "" {
+		os.Setenv("CAROOT", os.Getenv("CAROOT_PATH"))
+	}
+
+	cert, key, err := vproxy.MakeClientCert(name, c.String("out"))
+	if err != nil {
+		return fmt.Errorf("failed to create client cert: %v", err)
+	}
+	fmt.Printf("created client cert for %s\n  cert: %s\n  key:  %s\n", name, cert, key)
+	return nil
+}
+
+// vhostOptions from flags. Only flags which were explicitly set are used, so
+// that per-vhost options fall back to the daemon defaults.
+func vhostOptions(c *cli.Context) vproxy.VhostOptions {
+	opts := vproxy.VhostOptions{
+		TLSPolicy: vproxy.TLSPolicy{
+			TLSMinVersion: c.String("tls-min"),
+			TLSMaxVersion: c.String("tls-max"),
+			TLSCiphers:    c.StringSlice("tls-cipher"),
+			TLSCurves:     c.StringSlice("tls-curve"),
+			HTTP2:         boolFlag(c, "http2"),
+		},
+		RetryPolicy: vproxy.RetryPolicy{
+			RetryTimeout:     durationFlag(c, "retry-timeout"),
+			RetryMaxAttempts: c.Int("retry-max-attempts"),
+			RetryMethods:     upper(c.StringSlice("retry-method")),
+			RetryOn:          c.StringSlice("retry-on"),
+			RetryBodyLimit:   c.Int("retry-body-limit"),
+		},
+		HealthPolicy: vproxy.HealthPolicy{
+			HealthCheck:        boolFlag(c, "health-check"),
+			HealthPath:         c.String("health-path"),
+			HealthInterval:     durationFlag(c, "health-interval"),
+			HealthyThreshold:   c.Int("healthy-threshold"),
+			UnhealthyThreshold: c.Int("unhealthy-threshold"),
+		},
+		ForwardedPolicy: vproxy.ForwardedPolicy{
+			ForwardedMode:  c.String("forwarded-mode"),
+			TrustedProxies: c.StringSlice("trusted-proxy"),
+		},
+		CompressionPolicy: vproxy.CompressionPolicy{
+			Compress:          boolFlag(c, "compress"),
+			CompressEncodings: c.StringSlice("compress-encoding"),
+			CompressTypes:     c.StringSlice("compress-type"),
+			CompressMinSize:   c.Int("compress-min-size"),
+		},
+		NoCache:          boolFlag(c, "no-cache"),
+		RedirectHTTPS:    boolFlag(c, "redirect-https"),
+		HSTS:             boolFlag(c, "hsts"),
+		HSTSMaxAge:       c.Int("hsts-max-age"),
+		Capture:          boolFlag(c, "capture"),
+		CaptureSize:      c.Int("capture-size"),
+		CaptureBodyLimit: c.Int("capture-body-limit"),
+		HARFile:          c.String("har-file"),
+		RequestHeaders:   headerRules(c, "request-header"),
+		ResponseHeaders:  headerRules(c, "response-header"),
+		RewriteResponses: boolFlag(c, "rewrite-responses"),
+		ErrorPages:       absPath(c.String("error-pages")),
+		LogHistory:       c.Int("log-history"),
+		LogFiles:         boolFlag(c, "log-files"),
+		LogMaxSize:       c.Int("log-max-size"),
+		LogMaxFiles:      c.Int("log-max-files"),
+	}
+	return opts
+}
+
+// boolFlag returns nil unless the flag was explicitly set
+func boolFlag(c *cli.Context, name string) *bool {
+	if !c.IsSet(name) {
+		return nil
+	}
+	b := c.Bool(name)
+	return &b
+}
+
+// durationFlag returns "" unless the flag was explicitly set
+func durationFlag(c *cli.Context, name string) string {
+	if !c.IsSet(name) {
+		return ""
+	}
+	return c.Duration(name).String()
+}
+
+func upper(list []string) []string {
+	for i, s := range list {
+		list[i] = strings.ToUpper(s)
+	}
+	return list
+}
+
+// absPath so the daemon can find files relative to the client's working dir
+func absPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	if a, err := filepath.Abs(p); err == nil {
+		return a
+	}
+	return p
+}
+
+func inspectRequests(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("missing hostname")
+	}
+	client := createClient(c)
+	client.Inspect(c.Args().First(), c.Args().Get(1), c.Bool("json"))
+	return nil
+}
+
+func exportHAR(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("missing hostname")
+	}
+	since := ""
+	if c.IsSet("since") {
+		since = c.Duration("since").String()
+	}
+	createClient(c).HAR(c.Args().First(), since)
+	return nil
+}
+
+func replayRequest(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("usage: vproxy replay <hostname> <id>")
+	}
+	host, id := c.Args().Get(0), c.Args().Get(1)
+	client := createClient(c)
+
+	opts := vproxy.ReplayOptions{Headers: headerRules(c, "header"), JSON: c.Bool("json")}
+	if c.IsSet("data") {
+		data := c.String("data")
+		if strings.HasPrefix(data, "@") {
+			b, err := os.ReadFile(data[1:])
+			if err != nil {
+				return err
+			}
+			data = string(b)
+		}
+		opts.Body = &data
+	}
+
+	if c.Bool("edit") {
+		ex, err := client.Exchange(host, id)
+		if err != nil {
+			return err
+		}
+		if ex.Request.Truncated && opts.Body == nil {
+			return fmt.Errorf("request body was truncated at %d of %d bytes; use --data to replace it", len(ex.Request.Body), ex.Request.BodySize)
+		}
+		raw, err := editText(ex.RawRequest())
+		if err != nil {
+			return err
+		}
+		opts.Request = raw
+	}
+
+	client.Replay(host, id, opts)
+	return nil
+}
+
+// editText opens the given text in the user's editor and returns the result
+func editText(text string) (string, error) {
+	f, err := os.CreateTemp("", "vproxy-replay-*.http")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(text); err != nil {
+		return "", err
+	}
+	f.Close()
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+	args := append(strings.Fields(editor), f.Name())
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor failed: %w", err)
+	}
+
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func validateBinding(bind string) error {
 	if bind == "" || !reBinding.MatchString(bind) {
 		return fmt.Errorf("invalid binding: '%s' (expected format 'host:port', e.g., 'app.local.com:7000')", bind)
@@ -147,11 +420,38 @@ func startDaemon(c *cli.Context) error {
 	httpPort := c.Int("http")
 	httpsPort := c.Int("https")
 
+	vproxy.DefaultVhostOptions = vhostOptions(c)
+	if err := vproxy.DefaultVhostOptions.Validate(); err != nil {
+		return err
+	}
+
 	vhostMux := vproxy.CreateVhostMux([]string{}, httpsPort > 0)
 	loggedHandler := vproxy.NewLoggedHandler(vhostMux)
 
 	// start daemon
 	d := vproxy.NewDaemon(loggedHandler, listen, httpPort, httpsPort)
+	if err := d.SetLogFormat(c.String("log-format")); err != nil {
+		return err
+	}
+	if c.Bool("acme") {
+		d.EnableACME(c.StringSlice("acme-suffix"), c.Bool("acme-verify"))
+	}
+	if endpoint := c.String("otlp-endpoint"); endpoint != "" {
+		d.EnableOTLP(endpoint)
+	}
+	if c.Bool("dashboard") {
+		d.EnableDashboard()
+	}
+	if spec := c.String("tcp-ports"); spec != "" {
+		if err := d.SetTCPPorts(spec); err != nil {
+			return err
+		}
+	}
+	for _, url := range c.StringSlice("webhook") {
+		if err := d.AddWebhook(url); err != nil {
+			return err
+		}
+	}
 	d.Run()
 
 	return nil
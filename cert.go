@@ -1,10 +1,21 @@
 package vproxy
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"log"
+	"math/big"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jittering/truststore"
 )
@@ -56,13 +67,19 @@ func CertPath() string {
 
 // MakeCert for the give hostname, if it doesn't already exist.
 func MakeCert(host string) (certFile string, keyFile string, err error) {
+	return makeCert([]string{host})
+}
+
+// makeCert covering all of the given hostnames, if it doesn't already exist.
+// The first host names the cert files.
+func makeCert(hosts []string) (certFile string, keyFile string, err error) {
 	cp := CertPath() + string(filepath.Separator)
 	err = os.MkdirAll(cp, 0755)
 	if err != nil {
 		return "", "", err
 	}
 
-	cert, err := ts.CertFile([]string{host}, cp)
+	cert, err := ts.CertFile(hosts, cp)
 	if err != nil {
 		return "", "", err
 	}
@@ -72,9 +89,298 @@ func MakeCert(host string) (certFile string, keyFile string, err error) {
 	}
 
 	// generate new cert
-	cert, err = ts.MakeCert([]string{host}, cp)
+	cert, err = ts.MakeCert(hosts, cp)
 	if err != nil {
 		return "", "", err
 	}
+	for _, host := range hosts {
+		events.publish(Event{Type: EventCertIssued, Host: host, CertFile: cert.CertFile})
+	}
 	return cert.CertFile, cert.KeyFile, nil
 }
+
+// Renew certs which expire within this window
+var certRenewBefore = 30 * 24 * time.Hour
+
+// CertInfo describes a certificate issued by vproxy
+type CertInfo struct {
+	Host     string    `json:"host"`
+	CertFile string    `json:"cert_file"`
+	KeyFile  string    `json:"key_file"`
+	SANs     []string  `json:"sans"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+	InUse    bool      `json:"in_use"`
+
+	// set when the cert was not signed by the current CAROOT
+	CAMismatch bool `json:"ca_mismatch"`
+
+	isCA     bool
+	isClient bool
+}
+
+// Status of the cert, for display
+func (c CertInfo) Status() string {
+	status := "orphaned"
+	if c.InUse {
+		status = "in use"
+	}
+	if time.Now().After(c.NotAfter) {
+		status += ", expired"
+	} else if time.Until(c.NotAfter) < certRenewBefore {
+		status += ", expiring"
+	}
+	if c.CAMismatch {
+		status += ", ca mismatch"
+	}
+	return status
+}
+
+// loadCACert reads the root CA cert from CAROOT
+func loadCACert() (*x509.Certificate, error) {
+	return readCertFile(filepath.Join(CARootPath(), "rootCA.pem"))
+}
+
+// loadCA reads the root CA cert and key from CAROOT, for signing certs
+// outside of mkcert
+func loadCA() (*x509.Certificate, crypto.Signer, error) {
+	ca, err := loadCACert()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := os.ReadFile(filepath.Join(CARootPath(), "rootCA-key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, nil, fmt.Errorf("failed to read CA key: unexpected content")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("failed to read CA key: unsupported key type")
+	}
+	return ca, signer, nil
+}
+
+// signCert from the given template using the local CA. Returns the PEM
+// encoded chain (cert followed by CA).
+func signCert(tpl *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	ca, key, err := loadCA()
+	if err != nil {
+		return nil, err
+	}
+
+	tpl.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca, pub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	return chain, nil
+}
+
+// readCertFile parses the first certificate in the given PEM file
+func readCertFile(file string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// InspectCert loads the cert for the given host and checks it against the
+// current CA
+func InspectCert(host string) (*CertInfo, error) {
+	cp := CertPath() + string(filepath.Separator)
+	f, err := ts.CertFile([]string{host}, cp)
+	if err != nil {
+		return nil, err
+	}
+	return inspectCertFile(host, f.CertFile, f.KeyFile)
+}
+
+func inspectCertFile(host string, certFile string, keyFile string) (*CertInfo, error) {
+	cert, err := readCertFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &CertInfo{
+		Host:     host,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Issuer:   cert.Issuer.CommonName,
+		NotAfter: cert.NotAfter,
+		isCA:     cert.IsCA,
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageClientAuth {
+			info.isClient = true
+		} else if usage == x509.ExtKeyUsageServerAuth {
+			info.isClient = false
+			break
+		}
+	}
+	info.SANs = append(info.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+
+	ca, err := loadCACert()
+	if err != nil || cert.CheckSignatureFrom(ca) != nil {
+		info.CAMismatch = true
+	}
+	return info, nil
+}
+
+// NeedsRenewal returns true if the cert is expiring soon or was signed by
+// a different CA
+func (c CertInfo) NeedsRenewal() bool {
+	return c.CAMismatch || time.Until(c.NotAfter) < certRenewBefore
+}
+
+// ListCerts installed in CertPath. The given func is used to mark which certs
+// are currently in use.
+func ListCerts(inUse func(host string) bool) ([]*CertInfo, error) {
+	keys, err := filepath.Glob(filepath.Join(CertPath(), "*-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*CertInfo{}
+	for _, key := range keys {
+		host := strings.TrimSuffix(filepath.Base(key), "-key.pem")
+		info, err := inspectCertFile(host, strings.TrimSuffix(key, "-key.pem")+".pem", key)
+		if err != nil {
+			fmt.Printf("[*] warning: failed to read cert for %s: %s\n", host, err)
+			continue
+		}
+		if info.isCA || info.isClient {
+			// CAROOT may live in the same dir; never touch it
+			continue
+		}
+		info.InUse = inUse(host)
+		certs = append(certs, info)
+	}
+	return certs, nil
+}
+
+// RenewCert replaces any existing cert for the given host with a new one
+func RenewCert(host string) (certFile string, keyFile string, err error) {
+	return renewCert([]string{host})
+}
+
+// issueCert is makeCert; a var so that tests can make issuing fail
+var issueCert = makeCert
+
+// renewCert covering all of the given hostnames. The existing cert and key are
+// set aside while issuing and put back if that fails, so that they are never
+// left missing.
+func renewCert(hosts []string) (certFile string, keyFile string, err error) {
+	cert, err := ts.CertFile(hosts, CertPath()+string(filepath.Separator))
+	if err != nil {
+		return "", "", err
+	}
+	moved := []string{}
+	restore := func() {
+		for _, f := range moved {
+			os.Rename(f+".old", f)
+		}
+	}
+	for _, f := range []string{cert.CertFile, cert.KeyFile} {
+		if err := os.Rename(f, f+".old"); err == nil {
+			moved = append(moved, f)
+		} else if !os.IsNotExist(err) {
+			restore()
+			return "", "", err
+		}
+	}
+
+	certFile, keyFile, err = issueCert(hosts)
+	if err != nil {
+		restore()
+		return "", "", err
+	}
+	for _, f := range moved {
+		os.Remove(f + ".old")
+	}
+	return certFile, keyFile, nil
+}
+
+// RemoveCert deletes the cert and key files for the given host
+func RemoveCert(host string) error {
+	return removeCert([]string{host})
+}
+
+func removeCert(hosts []string) error {
+	cp := CertPath() + string(filepath.Separator)
+	cert, err := ts.CertFile(hosts, cp)
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{cert.CertFile, cert.KeyFile} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// MakeClientCert issues a client auth (mTLS) cert for the given name from the
+// local CA, saved into the given dir.
+func MakeClientCert(name string, dir string) (certFile string, keyFile string, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	tpl := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"vproxy client certificate"},
+			CommonName:   name,
+		},
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().AddDate(2, 3, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if email, err := mail.ParseAddress(name); err == nil && email.Address == name {
+		tpl.EmailAddresses = []string{name}
+	}
+
+	chain, err := signCert(tpl, priv.Public())
+	if err != nil {
+		return "", "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+
+	base := strings.NewReplacer("@", "_", " ", "_", "/", "_").Replace(name) + "-client"
+	certFile = filepath.Join(dir, base+".pem")
+	keyFile = filepath.Join(dir, base+"-key.pem")
+	if err = os.WriteFile(certFile, chain, 0644); err != nil {
+		return "", "", err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
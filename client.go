@@ -2,6 +2,7 @@ package vproxy
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,12 +15,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Client struct {
-	Addr string
-	cmd  *exec.Cmd
-	wg   *sync.WaitGroup
+	Addr      string
+	Options   VhostOptions  // options for any vhosts added by this client
+	LogFormat string        // format for streamed logs
+	TailSince time.Duration // stream logs since this long ago, rather than recent history
+	LogFilter LogFilter     // only stream matching log entries
+
+	cmd *exec.Cmd
+	wg  *sync.WaitGroup
 }
 
 func (c *Client) uri(path string) string {
@@ -71,6 +78,14 @@ func (c *Client) RunCommand(args []string) {
 func (c *Client) AddBinding(bind string, detach bool) {
 	data := url.Values{}
 	data.Add("binding", bind)
+	opts, err := json.Marshal(c.Options)
+	if err != nil {
+		stopCommand(c.cmd)
+		log.Fatalf("error encoding vhost options: %s\n", err)
+	}
+	if string(opts) != "{}" {
+		data.Add("options", string(opts))
+	}
 
 	s := strings.Split(bind, ":")
 	if len(s) >= 2 {
@@ -97,8 +112,12 @@ func (c *Client) AddBinding(bind string, detach bool) {
 }
 
 func (c *Client) Tail(hostname string, follow bool) {
-	data := url.Values{}
+	data := c.LogFilter.Values()
 	data.Add("host", hostname)
+	data.Add("format", c.LogFormat)
+	if c.TailSince > 0 {
+		data.Add("since", c.TailSince.String())
+	}
 	res, err := http.DefaultClient.PostForm(c.uri("/clients/stream"), data)
 	if err != nil {
 		log.Fatalf("error: %s\n", err)
@@ -162,3 +181,126 @@ func (c *Client) IsDaemonRunning() bool {
 	}
 	return strings.TrimSpace(string(body)) == PONG
 }
+
+// ListCerts issued by the daemon
+func (c *Client) ListCerts() {
+	res, err := http.DefaultClient.Get(c.uri("/certs"))
+	if err != nil {
+		log.Fatalf("error: %s\n", err)
+	}
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+}
+
+// PruneCerts removes certs for hosts which are no longer registered
+func (c *Client) PruneCerts() {
+	res, err := http.DefaultClient.PostForm(c.uri("/certs/prune"), url.Values{})
+	if err != nil {
+		log.Fatalf("error: %s\n", err)
+	}
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+}
+
+// Inspect lists the captured requests for the given host, or shows a single
+// one if an id is given
+func (c *Client) Inspect(hostname string, id string, asJSON bool) {
+	data := url.Values{}
+	data.Add("host", hostname)
+	if asJSON {
+		data.Add("format", LogFormatJSON)
+	}
+	uri := c.uri("/inspect")
+	if id != "" {
+		data.Add("id", id)
+		uri = c.uri("/inspect/show")
+	}
+	res, err := http.DefaultClient.PostForm(uri, data)
+	if err != nil {
+		log.Fatalf("error: %s\n", err)
+	}
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+	if res.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
+
+// Exchange fetches a single captured exchange
+func (c *Client) Exchange(hostname string, id string) (*Exchange, error) {
+	data := url.Values{}
+	data.Add("host", hostname)
+	data.Add("id", id)
+	data.Add("format", LogFormatJSON)
+	res, err := http.DefaultClient.PostForm(c.uri("/inspect/show"), data)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("%s", strings.TrimPrefix(strings.TrimSpace(string(b)), "error: "))
+	}
+	ex := &Exchange{}
+	if err := json.NewDecoder(res.Body).Decode(ex); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// ReplayOptions modify a replayed request
+type ReplayOptions struct {
+	Request string   // raw request replacing the original, if set
+	Headers []string // "Name: value" overrides
+	Body    *string  // replacement body, if set
+	JSON    bool
+}
+
+// Replay re-sends a retained request through the vhost and prints the new
+// exchange
+func (c *Client) Replay(hostname string, id string, opts ReplayOptions) {
+	data := url.Values{}
+	data.Add("host", hostname)
+	data.Add("id", id)
+	if opts.Request != "" {
+		data.Add("request", opts.Request)
+	}
+	for _, h := range opts.Headers {
+		data.Add("header", h)
+	}
+	if opts.Body != nil {
+		data.Add("replace_body", "true")
+		data.Add("body", *opts.Body)
+	}
+	if opts.JSON {
+		data.Add("format", LogFormatJSON)
+	}
+	res, err := http.DefaultClient.PostForm(c.uri("/replay"), data)
+	if err != nil {
+		log.Fatalf("error: %s\n", err)
+	}
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+	if res.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
+
+// HAR writes the retained exchanges for the given host to stdout in HAR format
+func (c *Client) HAR(hostname string, since string) {
+	data := url.Values{}
+	data.Add("host", hostname)
+	if since != "" {
+		data.Add("since", since)
+	}
+	res, err := http.DefaultClient.PostForm(c.uri("/har"), data)
+	if err != nil {
+		log.Fatalf("error: %s\n", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(os.Stderr, res.Body)
+		os.Exit(1)
+	}
+	io.Copy(os.Stdout, res.Body)
+}
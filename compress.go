@@ -0,0 +1,237 @@
+package vproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionPolicy controls compression of upstream responses, for parity
+// with a CDN in production. Empty values use the defaults below.
+type CompressionPolicy struct {
+	Compress          *bool    `json:"compress,omitempty"`           // default: false
+	CompressEncodings []string `json:"compress_encodings,omitempty"` // in order of preference
+	CompressTypes     []string `json:"compress_types,omitempty"`     // content types, e.g. "text/*"
+	CompressMinSize   int      `json:"compress_min_size,omitempty"`  // bytes
+}
+
+// Supported encodings
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+)
+
+// Encodings lists the valid values for CompressEncodings
+var Encodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// Compression defaults
+var (
+	defaultCompressTypes = []string{
+		"text/*",
+		"application/javascript",
+		"application/json",
+		"application/*+json",
+		"application/xml",
+		"application/*+xml",
+		"application/wasm",
+		"image/svg+xml",
+	}
+	defaultCompressMinSize = 1024
+)
+
+// Validate the policy
+func (p CompressionPolicy) Validate() error {
+	for _, enc := range p.CompressEncodings {
+		if !contains(Encodings, enc) {
+			return fmt.Errorf("invalid encoding '%s' (expected one of: %s)", enc, strings.Join(Encodings, ", "))
+		}
+	}
+	for _, t := range p.CompressTypes {
+		if _, err := path.Match(t, ""); err != nil || !strings.Contains(t, "/") {
+			return fmt.Errorf("invalid content type '%s'", t)
+		}
+	}
+	if p.CompressMinSize < 0 {
+		return fmt.Errorf("invalid compression min size: %d", p.CompressMinSize)
+	}
+	return nil
+}
+
+// compressor encodes responses using the best encoding accepted by the client
+type compressor struct {
+	encodings []string
+	types     []string
+	minSize   int
+}
+
+// newCompressor for the policy, or nil if compression is disabled
+func newCompressor(p CompressionPolicy) *compressor {
+	if !isTrue(p.Compress) {
+		return nil
+	}
+	c := &compressor{encodings: Encodings, types: defaultCompressTypes, minSize: defaultCompressMinSize}
+	if len(p.CompressEncodings) > 0 {
+		c.encodings = make([]string, len(p.CompressEncodings))
+		for i, enc := range p.CompressEncodings {
+			c.encodings[i] = strings.ToLower(enc)
+		}
+	}
+	if len(p.CompressTypes) > 0 {
+		c.types = p.CompressTypes
+	}
+	if p.CompressMinSize > 0 {
+		c.minSize = p.CompressMinSize
+	}
+	return c
+}
+
+// compress the response body, if the client accepts it and the response is
+// eligible
+func (c *compressor) compress(res *http.Response) {
+	if res.Request == nil || res.Request.Method == http.MethodHead ||
+		res.StatusCode < 200 || res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusPartialContent || res.StatusCode == http.StatusNotModified ||
+		res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Range") != "" ||
+		strings.Contains(res.Header.Get("Cache-Control"), "no-transform") ||
+		!c.compressible(res.Header.Get("Content-Type")) {
+		return
+	}
+	if res.ContentLength >= 0 && res.ContentLength < int64(c.minSize) {
+		return
+	}
+	encoding := negotiateEncoding(res.Request.Header.Get("Accept-Encoding"), c.encodings)
+	if encoding == "" {
+		return
+	}
+
+	if res.ContentLength < 0 {
+		// unknown length: peek to see if it's worth it
+		br := bufio.NewReaderSize(res.Body, c.minSize)
+		peeked, _ := br.Peek(c.minSize)
+		res.Body = readCloser{br, res.Body}
+		if len(peeked) < c.minSize {
+			return
+		}
+	}
+
+	cr := &compressReader{src: res.Body, chunk: make([]byte, 32*1024)}
+	switch encoding {
+	case EncodingGzip:
+		cr.enc = gzip.NewWriter(&cr.buf)
+	case EncodingBrotli:
+		cr.enc = brotli.NewWriter(&cr.buf)
+	case EncodingZstd:
+		cr.enc, _ = zstd.NewWriter(&cr.buf, zstd.WithEncoderConcurrency(1))
+	}
+	res.Body = cr
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	res.Header.Del("Accept-Ranges")
+	res.Header.Set("Content-Encoding", encoding)
+	res.Header.Add("Vary", "Accept-Encoding")
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+func (c *compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false // streamed, must not be buffered
+	}
+	for _, t := range c.types {
+		if ok, _ := path.Match(strings.ToLower(t), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the first of the given encodings with the highest
+// q-value in the Accept-Encoding header, or "" if none are acceptable
+func negotiateEncoding(accept string, encodings []string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, _ = strconv.ParseFloat(v, 64)
+		}
+		weights[name] = weight
+	}
+
+	best, bestWeight := "", 0.0
+	for _, enc := range encodings {
+		weight, ok := weights[enc]
+		if !ok {
+			weight = weights["*"]
+		}
+		if weight > bestWeight {
+			best, bestWeight = enc, weight
+		}
+	}
+	return best
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// compressReader encodes the source body as it is read. The encoder is
+// flushed after each read so that slow responses are still streamed.
+type compressReader struct {
+	src   io.ReadCloser
+	enc   io.WriteCloser
+	buf   bytes.Buffer
+	chunk []byte
+	eof   bool
+}
+
+type flusher interface {
+	Flush() error
+}
+
+func (cr *compressReader) Read(p []byte) (int, error) {
+	for cr.buf.Len() == 0 && !cr.eof {
+		n, err := cr.src.Read(cr.chunk)
+		if n > 0 {
+			cr.enc.Write(cr.chunk[:n])
+		}
+		if err == io.EOF {
+			cr.eof = true
+			cr.enc.Close()
+		} else if err != nil {
+			return 0, err
+		} else if f, ok := cr.enc.(flusher); ok && n > 0 {
+			f.Flush()
+		}
+	}
+	if cr.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return cr.buf.Read(p)
+}
+
+func (cr *compressReader) Close() error {
+	if !cr.eof {
+		cr.eof = true
+		cr.enc.Close()
+	}
+	return cr.src.Close()
+}
@@ -0,0 +1,114 @@
+package vproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "zstd", negotiateEncoding("gzip, deflate, br, zstd", Encodings))
+	assert.Equal(t, "br", negotiateEncoding("gzip, br", Encodings))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip;q=1.0, br;q=0.5", Encodings))
+	assert.Equal(t, "gzip", negotiateEncoding("GZIP", Encodings))
+	assert.Equal(t, "zstd", negotiateEncoding("*", Encodings))
+	assert.Equal(t, "br", negotiateEncoding("*, zstd;q=0", Encodings))
+	assert.Equal(t, "", negotiateEncoding("identity", Encodings))
+	assert.Equal(t, "", negotiateEncoding("", Encodings))
+	assert.Equal(t, "gzip", negotiateEncoding("br, gzip", []string{"gzip"}))
+}
+
+func TestCompressResponses(t *testing.T) {
+	reset()
+	page := strings.Repeat("<p>hello vproxy</p>\n", 200)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "tiny")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, page)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, page)
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	on := true
+	proxy := CreateProxyWithOptions(*u, "app.local", VhostOptions{CompressionPolicy: CompressionPolicy{Compress: &on}})
+	get := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://app.local"+path, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		r := httptest.NewRecorder()
+		proxy.ServeHTTP(r, req)
+		return r
+	}
+
+	decoders := map[string]func(io.Reader) io.Reader{
+		"gzip": func(r io.Reader) io.Reader { zr, _ := gzip.NewReader(r); return zr },
+		"br":   func(r io.Reader) io.Reader { return brotli.NewReader(r) },
+		"zstd": func(r io.Reader) io.Reader { zr, _ := zstd.NewReader(r); return zr },
+	}
+	for encoding, decode := range decoders {
+		r := get("/", encoding)
+		assert.Equal(t, encoding, r.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", r.Header().Get("Vary"))
+		assert.Equal(t, `W/"v1"`, r.Header().Get("ETag"))
+		assert.Equal(t, "", r.Header().Get("Content-Length"))
+		assert.True(t, r.Body.Len() < len(page))
+		body, err := io.ReadAll(decode(r.Body))
+		assert.Nil(t, err)
+		assert.Equal(t, page, string(body))
+	}
+
+	// not eligible
+	assert.Equal(t, "", get("/small", "gzip").Header().Get("Content-Encoding"))
+	assert.Equal(t, "", get("/image", "gzip").Header().Get("Content-Encoding"))
+	r := get("/", "identity")
+	assert.Equal(t, "", r.Header().Get("Content-Encoding"))
+	assert.Equal(t, page, r.Body.String())
+
+	assert.NotNil(t, CompressionPolicy{CompressEncodings: []string{"deflate"}}.Validate())
+	assert.NotNil(t, CompressionPolicy{CompressTypes: []string{"[text"}}.Validate())
+}
+
+func TestNoCache(t *testing.T) {
+	reset()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 19 Oct 2026 10:00:00 GMT")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		io.WriteString(w, "app.js")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	on := true
+	proxy := CreateProxyWithOptions(*u, "app.local", VhostOptions{NoCache: &on})
+	req := httptest.NewRequest("GET", "http://app.local/app.js", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	r := httptest.NewRecorder()
+	proxy.ServeHTTP(r, req)
+
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "app.js", r.Body.String())
+	assert.Equal(t, "no-store", r.Header().Get("Cache-Control"))
+	assert.Equal(t, "", r.Header().Get("ETag"))
+	assert.Equal(t, "", r.Header().Get("Last-Modified"))
+}
@@ -9,10 +9,14 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/mattn/go-isatty"
 )
@@ -23,6 +27,9 @@ var VERBOSE = false
 // PONG server identifier
 const PONG = "hello from vproxy"
 
+// How often to check for expiring certs
+var certCheckInterval = 12 * time.Hour
+
 // Daemon service which hosts all the virtual reverse proxies
 //
 // proxy chain:
@@ -30,6 +37,10 @@ const PONG = "hello from vproxy"
 type Daemon struct {
 	wg sync.WaitGroup
 
+	// guards changes to vhosts (add, remove, cert renewal) and reads of the
+	// vhost list by control handlers
+	mu sync.Mutex
+
 	loggedHandler *LoggedHandler
 
 	listenHost string
@@ -41,15 +52,79 @@ type Daemon struct {
 	httpsPort     int
 	httpsAddr     string
 	httpsListener net.Listener
+
+	acme       *acmeServer
+	acmeVerify bool
+	dashboard  bool
+
+	tcpPorts []int // pool for TCP vhosts with an "auto" port
 }
 
 // NewDaemon
 func NewDaemon(lh *LoggedHandler, listen string, httpPort int, httpsPort int) *Daemon {
 	d := &Daemon{loggedHandler: lh, listenHost: listen, httpPort: httpPort, httpsPort: httpsPort}
+	d.tcpPorts, _ = parsePorts(defaultTCPPorts)
 	d.loadVhosts()
 	return d
 }
 
+// SetTCPPorts sets the range of ports, e.g. "20000-20999", from which TCP
+// vhosts registered with an "auto" port are assigned one
+func (d *Daemon) SetTCPPorts(spec string) error {
+	ports, err := parsePorts(spec)
+	if err != nil {
+		return err
+	}
+	d.tcpPorts = ports
+	return nil
+}
+
+// SetLogFormat for access logs printed by the daemon
+func (d *Daemon) SetLogFormat(format string) error {
+	return d.loggedHandler.SetLogFormat(format)
+}
+
+// EnableACME serves an ACME directory at /_vproxy/acme/directory which issues
+// certs from the local CA for names ending in one of the given suffixes. When
+// verify is true, http-01 challenges are checked via the daemon's HTTP listener,
+// otherwise all challenges are accepted as-is.
+func (d *Daemon) EnableACME(suffixes []string, verify bool) {
+	if len(suffixes) == 0 {
+		suffixes = DefaultACMESuffixes
+	}
+	d.acme = newACMEServer(suffixes)
+	d.acmeVerify = verify
+}
+
+// EnableOTLP exports a span for each proxied request to the given OTLP/HTTP
+// collector endpoint, e.g. http://127.0.0.1:4318
+func (d *Daemon) EnableOTLP(endpoint string) {
+	d.loggedHandler.spans = newSpanExporter(endpoint)
+}
+
+// EnableDashboard serves the web dashboard at the daemon's own hostname
+// (vproxy.local)
+func (d *Daemon) EnableDashboard() {
+	d.dashboard = true
+}
+
+func (d *Daemon) startDashboard() {
+	lh := d.loggedHandler
+	lh.dashboard = http.HandlerFunc(d.serveDashboard)
+	if err := addToHosts(lh.defaultHost); err != nil {
+		fmt.Printf("[*] warning: failed to add %s to system hosts file: %s\n", lh.defaultHost, err)
+	}
+	scheme, port := "https", d.httpsPort
+	if !d.enableTLS() {
+		scheme, port = "http", d.httpPort
+	}
+	if (scheme == "https" && port == 443) || (scheme == "http" && port == 80) {
+		fmt.Printf("[*] dashboard: %s://%s\n", scheme, lh.defaultHost)
+	} else {
+		fmt.Printf("[*] dashboard: %s://%s:%d\n", scheme, lh.defaultHost, port)
+	}
+}
+
 func rerunWithSudo(addr string) {
 	// ensure sudo exists on this OS
 	_, err := os.Stat("/usr/bin/sudo")
@@ -115,12 +190,19 @@ func (d *Daemon) Shutdown() {
 	if d.enableTLS() && d.httpsListener != nil {
 		d.httpsListener.Close()
 	}
+	if d.loggedHandler.spans != nil {
+		d.loggedHandler.spans.Close()
+	}
+	for _, vhost := range d.loggedHandler.vhostMux.Servers {
+		vhost.tcp.Stop()
+	}
 }
 
 // Run the daemon service. Does not return until the service is killed.
 func (d *Daemon) Run() {
 	d.httpAddr = fmt.Sprintf("%s:%d", d.listenHost, d.httpPort)
 	d.httpsAddr = fmt.Sprintf("%s:%d", d.listenHost, d.httpsPort)
+	d.loggedHandler.httpsPort = d.httpsPort
 
 	// require running as root if needed
 	if d.enableHTTP() && d.httpPort < 1024 {
@@ -135,6 +217,21 @@ func (d *Daemon) Run() {
 	d.loggedHandler.HandleFunc("/_vproxy/clients/add", d.registerVhost)
 	d.loggedHandler.HandleFunc("/_vproxy/clients/stream", d.streamLogs)
 	d.loggedHandler.HandleFunc("/_vproxy/clients/remove", d.removeVhost)
+	d.loggedHandler.HandleFunc("/_vproxy/inspect", d.inspectList)
+	d.loggedHandler.HandleFunc("/_vproxy/inspect/show", d.inspectShow)
+	d.loggedHandler.HandleFunc("/_vproxy/replay", d.replayRequest)
+	d.loggedHandler.HandleFunc("/_vproxy/har", d.exportHAR)
+	d.loggedHandler.HandleFunc("/_vproxy/metrics", d.serveMetrics)
+	d.loggedHandler.HandleFunc("/_vproxy/certs", d.listCerts)
+	d.loggedHandler.HandleFunc("/_vproxy/certs/prune", d.pruneCerts)
+	d.loggedHandler.HandleFunc("/_vproxy/dashboard/logs", d.dashboardLogs)
+	d.loggedHandler.HandleFunc("/_vproxy/events", d.streamEvents)
+	if d.dashboard {
+		d.startDashboard()
+	}
+	if d.acme != nil {
+		d.startACME()
+	}
 	d.wg.Add(1) // ensure we don't exit immediately
 
 	if d.enableHTTP() {
@@ -144,13 +241,34 @@ func (d *Daemon) Run() {
 
 	if d.enableTLS() {
 		fmt.Printf("[*] starting proxy: https://%s\n", d.httpsAddr)
+		d.renewCerts()
 		d.loggedHandler.DumpServers(os.Stdout)
 		go d.startTLS()
+		go d.watchCerts()
 	}
 
 	d.wg.Wait()
 }
 
+func (d *Daemon) startACME() {
+	if d.acmeVerify {
+		if !d.enableHTTP() {
+			fmt.Println("[*] warning: acme http-01 validation requires the http listener; accepting all challenges")
+		} else {
+			// always check via loopback, even when listening on all IPs
+			d.acme.verifyAddr = fmt.Sprintf("127.0.0.1:%d", d.httpPort)
+		}
+	}
+	d.loggedHandler.Handle(acmePrefix+"/", d.acme)
+	d.loggedHandler.acme = d.acme
+
+	scheme, port := "https", d.httpsPort
+	if !d.enableTLS() {
+		scheme, port = "http", d.httpPort
+	}
+	fmt.Printf("[*] acme directory: %s://%s:%d%s/directory\n", scheme, d.loggedHandler.defaultHost, port, acmePrefix)
+}
+
 func (d *Daemon) enableHTTP() bool {
 	return d.httpPort > 0
 }
@@ -171,7 +289,7 @@ func (d *Daemon) startHTTP() {
 	nullLogger := log.New(null, "", 0)
 	defer null.Close()
 
-	server := &http.Server{Handler: d.loggedHandler, ErrorLog: nullLogger}
+	server := &http.Server{Handler: d.loggedHandler, ErrorLog: nullLogger, ConnState: metrics.connState}
 	server.Serve(d.httpListener)
 	d.wg.Done()
 }
@@ -188,9 +306,14 @@ func (d *Daemon) startTLS() {
 	// nullLogger := log.New(null, "", 0)
 	// defer null.Close()
 
+	d.mu.Lock()
+	tlsConfig := d.loggedHandler.CreateTLSConfig()
+	d.mu.Unlock()
+
 	server := http.Server{
 		Handler:   d.loggedHandler,
-		TLSConfig: d.loggedHandler.CreateTLSConfig(),
+		TLSConfig: tlsConfig,
+		ConnState: metrics.connState,
 		// ErrorLog:  nullLogger,
 	}
 
@@ -209,7 +332,16 @@ func (d *Daemon) restartTLS() {
 // registerVhost handler creates and starts a new vhost reverse proxy
 func (d *Daemon) registerVhost(w http.ResponseWriter, r *http.Request) {
 	binding := r.PostFormValue("binding")
-	d.addVhost(binding, w)
+
+	var opts VhostOptions
+	if o := r.PostFormValue("options"); o != "" {
+		if err := json.Unmarshal([]byte(o), &opts); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid vhost options: %s", err)
+			return
+		}
+	}
+	d.addVhostWithOptions(binding, opts, w)
 }
 
 // streamLogs for a given hostname back to the caller. Runs forever until client
@@ -222,11 +354,37 @@ func (d *Daemon) streamLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	format := r.PostFormValue("format")
+	if err := ValidateLogFormat(format); err != nil {
+		fmt.Fprintf(w, "[*] error: %s", err)
+		return
+	}
+	filter, err := ParseLogFilter(r.PostForm)
+	if err != nil {
+		fmt.Fprintf(w, "[*] error: %s", err)
+		return
+	}
+
+	// recent logs to send first: either the in-memory history or everything
+	// since the given time
+	backlog := vhost.BufferedLogs()
+	if s := r.PostFormValue("since"); s != "" {
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			fmt.Fprintf(w, "[*] error: invalid since '%s': %s", s, err)
+			return
+		}
+		if backlog, err = vhost.LogsSince(time.Now().Add(-dur)); err != nil {
+			fmt.Fprintf(w, "[*] error: failed to read logs: %s", err)
+			return
+		}
+	}
+
 	// runs forever until connection closes
-	d.relayLogsUntilClose(vhost, w, r.Context())
+	d.relayLogsUntilClose(vhost, format, filter, backlog, w, r.Context())
 }
 
-func (d *Daemon) relayLogsUntilClose(vhost *Vhost, w http.ResponseWriter, reqCtx context.Context) {
+func (d *Daemon) relayLogsUntilClose(vhost *Vhost, format string, filter *LogFilter, backlog []*LogEntry, w http.ResponseWriter, reqCtx context.Context) {
 	flusher, ok := w.(*LogRecord).ResponseWriter.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
@@ -239,10 +397,13 @@ func (d *Daemon) relayLogsUntilClose(vhost *Vhost, w http.ResponseWriter, reqCtx
 
 	logChan := vhost.NewLogListener()
 
-	// read existing logs first
-	buff := vhost.BufferAsString()
-	if buff != "" {
-		fmt.Fprint(w, buff)
+	// send existing logs first
+	if len(backlog) > 0 {
+		for _, entry := range backlog {
+			if filter.Match(entry) {
+				fmt.Fprintln(w, entry.Format(format))
+			}
+		}
 		fmt.Fprintln(w, "---")
 	}
 
@@ -252,8 +413,11 @@ func (d *Daemon) relayLogsUntilClose(vhost *Vhost, w http.ResponseWriter, reqCtx
 		case <-reqCtx.Done():
 			vhost.RemoveLogListener(logChan)
 			return
-		case line := <-logChan:
-			fmt.Fprintln(w, line)
+		case entry := <-logChan:
+			if !filter.Match(entry) {
+				continue
+			}
+			fmt.Fprintln(w, entry.Format(format))
 			flusher.Flush()
 		}
 	}
@@ -264,12 +428,14 @@ func (d *Daemon) removeVhost(w http.ResponseWriter, r *http.Request) {
 	all, _ := strconv.ParseBool(r.PostFormValue("all"))
 
 	if all {
-		for _, vhost := range d.loggedHandler.vhostMux.Servers {
+		for _, vhost := range d.vhosts() {
 			d.doRemoveVhost(vhost, w)
 		}
 
 	} else if hostname != "" {
+		d.mu.Lock()
 		vhost := d.loggedHandler.GetVhost(hostname)
+		d.mu.Unlock()
 		if vhost == nil {
 			fmt.Fprintf(w, "error: host '%s' not found", hostname)
 			return
@@ -283,13 +449,59 @@ func (d *Daemon) removeVhost(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// doRemoveVhost along with any aliases of it, cleaning up certs which were
+// shared with aliases
 func (d *Daemon) doRemoveVhost(vhost *Vhost, w http.ResponseWriter) {
-	fmt.Printf("[*] removing vhost: %s -> %d\n", vhost.Host, vhost.ServicePort)
-	fmt.Fprintf(w, "removing vhost: %s -> %d\n", vhost.Host, vhost.ServicePort)
-	d.loggedHandler.RemoveVhost(vhost.Host)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lh := d.loggedHandler
+	if lh.GetVhost(vhost.Host) != vhost {
+		return // already removed, e.g. as an alias
+	}
+
+	removed := []*Vhost{vhost}
+	if vhost.Options.AliasOf == "" {
+		for _, v := range lh.vhostMux.Servers {
+			if v.Options.AliasOf == vhost.Host {
+				removed = append(removed, v)
+			}
+		}
+	}
+	for _, v := range removed {
+		fmt.Printf("[*] removing vhost: %s\n", v)
+		fmt.Fprintf(w, "removing vhost: %s\n", v)
+		lh.RemoveVhost(v.Host)
+		events.publish(Event{Type: EventVhostRemoved, Host: v.Host})
+	}
+
+	// remaining aliases (or their target) get a cert for the new set of names
+	if d.shareAliasCerts() && d.httpsListener != nil {
+		d.restartTLS()
+	}
+	cleaned := map[string]bool{}
+	for _, v := range removed {
+		name := certName(v.Cert)
+		if v.Cert != "" && name != v.Host && !cleaned[name] && !d.certInUse(name) {
+			cleaned[name] = true
+			os.Remove(v.Cert)
+			os.Remove(v.Key)
+			fmt.Printf("[*] removed cert: %s\n", name)
+		}
+	}
 	d.saveVhosts()
 }
 
+// vhosts returns a snapshot of all registered vhosts
+func (d *Daemon) vhosts() []*Vhost {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vhosts := []*Vhost{}
+	for _, v := range d.loggedHandler.vhostMux.Servers {
+		vhosts = append(vhosts, v)
+	}
+	return vhosts
+}
+
 // load saved vhosts from disk
 func (d *Daemon) loadVhosts() {
 	c := path.Join(CertPath(), "vhosts.json")
@@ -309,6 +521,9 @@ func (d *Daemon) loadVhosts() {
 	}
 	for _, vhost := range servers {
 		vhost.Init()
+		if err := d.startTCP(vhost); err != nil {
+			fmt.Printf("[*] warning: failed to forward tcp for %s: %s\n", vhost.Host, err)
+		}
 		d.loggedHandler.AddVhost(vhost)
 		err = addToHosts(vhost.Host)
 		if err != nil {
@@ -337,21 +552,54 @@ func (d *Daemon) saveVhosts() {
 
 // addVhost for the given binding to the LoggedHandler
 func (d *Daemon) addVhost(binding string, w http.ResponseWriter) *Vhost {
-	vhost, err := CreateVhost(binding, d.enableTLS())
+	return d.addVhostWithOptions(binding, VhostOptions{}, w)
+}
+
+// addVhostWithOptions for the given binding to the LoggedHandler
+func (d *Daemon) addVhostWithOptions(binding string, opts VhostOptions, w http.ResponseWriter) *Vhost {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vhost, err := CreateVhostWithOptions(binding, d.enableTLS(), opts)
 	if err != nil {
 		fmt.Printf("[*] warning: failed to register new vhost `%s`\n", binding)
 		fmt.Printf("    %s\n", err)
 		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %s", err)
 		return nil
 	}
 
+	if target := opts.AliasOf; target != "" {
+		if v := d.loggedHandler.GetVhost(target); v == nil || v.Options.AliasOf != "" {
+			fmt.Printf("[*] warning: failed to register new vhost `%s`: unknown alias target %s\n", binding, target)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: unknown alias target: %s (must be a registered vhost, not an alias)", target)
+			return nil
+		}
+	}
+
 	// remove any existing vhost
+	event := Event{Type: EventVhostAdded, Host: vhost.Host, Upstream: vhost.upstream()}
 	if v := d.loggedHandler.GetVhost(vhost.Host); v != nil {
-		fmt.Printf("[*] removing existing vhost: %s -> %d\n", v.Host, v.ServicePort)
+		fmt.Printf("[*] removing existing vhost: %s\n", v)
 		d.loggedHandler.RemoveVhost(vhost.Host)
+		event.Type = EventVhostReplaced
+	}
+
+	if err := d.startTCP(vhost); err != nil {
+		fmt.Printf("[*] warning: failed to register new vhost `%s`\n", binding)
+		fmt.Printf("    failed to forward tcp: %s\n", err)
+		vhost.Close()
+		if event.Type == EventVhostReplaced {
+			d.saveVhosts()
+			events.publish(Event{Type: EventVhostRemoved, Host: vhost.Host})
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: failed to forward tcp: %s", err)
+		return nil
 	}
 
-	fmt.Printf("[*] registering new vhost: %s -> %d\n", vhost.Host, vhost.ServicePort)
+	fmt.Printf("[*] registering new vhost: %s\n", vhost)
 
 	// Set the headers related to event streaming.
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -360,7 +608,9 @@ func (d *Daemon) addVhost(binding string, w http.ResponseWriter) *Vhost {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	d.loggedHandler.AddVhost(vhost)
+	d.shareAliasCerts()
 	d.saveVhosts()
+	events.publish(event)
 
 	if d.enableTLS() {
 		d.restartTLS()
@@ -373,11 +623,56 @@ func (d *Daemon) addVhost(binding string, w http.ResponseWriter) *Vhost {
 		fmt.Fprintln(w, msg)
 	}
 
+	if vhost.tcp != nil {
+		fmt.Printf("[*] forwarding tcp: :%s -> %s\n", vhost.Options.TCP, vhost.upstream())
+		fmt.Fprintf(w, "[*] forwarding tcp: :%s -> %s\n", vhost.Options.TCP, vhost.upstream())
+	}
 	fmt.Fprintf(w, "[*] added vhost: %s", binding)
 
 	return vhost
 }
 
+// startTCP forwarder for the vhost, if it has a TCP port. "auto" is resolved
+// to a free port from the daemon's pool, which is then kept with the vhost.
+func (d *Daemon) startTCP(vhost *Vhost) error {
+	spec := vhost.Options.TCP
+	if spec == "" {
+		return nil
+	}
+	if spec != TCPAuto {
+		ports, err := parsePorts(spec)
+		if err != nil {
+			return err
+		}
+		vhost.tcp, err = startTCPForwarder(d.loggedHandler, vhost, d.listenHost, ports)
+		return err
+	}
+
+	used := map[int]bool{}
+	for _, v := range d.loggedHandler.vhostMux.Servers {
+		if ports, err := parsePorts(v.Options.TCP); err == nil {
+			for _, port := range ports {
+				used[port] = true
+			}
+		}
+	}
+	for _, port := range d.tcpPorts {
+		if used[port] {
+			continue
+		}
+		f, err := startTCPForwarder(d.loggedHandler, vhost, d.listenHost, []int{port})
+		if _, ok := err.(*net.OpError); ok {
+			continue // port taken by another process
+		} else if err != nil {
+			return err
+		}
+		vhost.tcp = f
+		vhost.Options.TCP = strconv.Itoa(port)
+		return nil
+	}
+	return fmt.Errorf("no free port in tcp range %d-%d", d.tcpPorts[0], d.tcpPorts[len(d.tcpPorts)-1])
+}
+
 func (d *Daemon) hello(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 	fmt.Fprintln(w, PONG)
@@ -385,6 +680,195 @@ func (d *Daemon) hello(w http.ResponseWriter, r *http.Request) {
 
 // listClients currently connected to the vproxy daemon
 func (d *Daemon) listClients(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("format") == LogFormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.vhostStatuses())
+		return
+	}
 	w.WriteHeader(200)
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.loggedHandler.DumpServers(w)
 }
+
+// listCerts issued by vproxy, along with their status
+func (d *Daemon) listCerts(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	certs, err := ListCerts(d.certInUse)
+	d.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: failed to list certs: %s\n", err)
+		return
+	}
+
+	w.WriteHeader(200)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSANS\tISSUER\tEXPIRES\tSTATUS")
+	for _, c := range certs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.Host, strings.Join(c.SANs, ","),
+			c.Issuer, c.NotAfter.Format("2006-01-02"), c.Status())
+	}
+	tw.Flush()
+}
+
+// pruneCerts removes certs for any hosts which are no longer registered
+func (d *Daemon) pruneCerts(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	certs, err := ListCerts(d.certInUse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: failed to list certs: %s\n", err)
+		return
+	}
+
+	count := 0
+	for _, c := range certs {
+		if c.InUse {
+			continue
+		}
+		if err := RemoveCert(c.Host); err != nil {
+			fmt.Fprintf(w, "error: failed to remove cert for %s: %s\n", c.Host, err)
+			continue
+		}
+		fmt.Printf("[*] removed cert: %s\n", c.Host)
+		fmt.Fprintf(w, "removed cert: %s\n", c.Host)
+		count++
+	}
+	fmt.Fprintf(w, "pruned %d cert(s)\n", count)
+}
+
+func (d *Daemon) certInUse(host string) bool {
+	if host == d.loggedHandler.defaultHost || d.loggedHandler.GetVhost(host) != nil {
+		return true
+	}
+	// certs shared with aliases are named e.g. "app.local+1"
+	for _, v := range d.loggedHandler.vhostMux.Servers {
+		if v.Cert != "" && certName(v.Cert) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// certName for the given cert file, e.g. "app.local" or "app.local+1" for a
+// cert shared with aliases
+func certName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), ".pem")
+}
+
+// shareAliasCerts issues a cert covering each vhost and its aliases, which is
+// then used by all of them. Returns true if any vhost's cert changed. Must be
+// called while holding the lock.
+func (d *Daemon) shareAliasCerts() bool {
+	if !d.enableTLS() {
+		return false
+	}
+	servers := d.loggedHandler.vhostMux.Servers
+	aliases := map[string][]string{}
+	for _, v := range servers {
+		if target := v.Options.AliasOf; target != "" && servers[target] != nil {
+			aliases[target] = append(aliases[target], v.Host)
+		}
+	}
+
+	changed := false
+	for target, names := range aliases {
+		sort.Strings(names)
+		hosts := append([]string{target}, names...)
+		cert, key, err := makeCert(hosts)
+		if err == nil {
+			if info, err := inspectCertFile(target, cert, key); err == nil && info.NeedsRenewal() {
+				cert, key, err = renewCert(hosts)
+			}
+		}
+		if err != nil {
+			fmt.Printf("[*] warning: failed to issue cert for %s: %s\n", strings.Join(hosts, ", "), err)
+			continue
+		}
+		for _, host := range hosts {
+			if v := servers[host]; v.Cert != cert {
+				v.Cert, v.Key = cert, key
+				changed = true
+			}
+		}
+	}
+
+	// vhosts whose last alias was removed go back to their own cert
+	for _, v := range servers {
+		if v.Cert == "" || v.Options.AliasOf != "" || aliases[v.Host] != nil || certName(v.Cert) == v.Host {
+			continue
+		}
+		cert, key, err := MakeCert(v.Host)
+		if err != nil {
+			fmt.Printf("[*] warning: failed to issue cert for %s: %s\n", v.Host, err)
+			continue
+		}
+		v.Cert, v.Key = cert, key
+		changed = true
+	}
+	return changed
+}
+
+// watchCerts periodically renews certs, restarting the TLS listener as needed
+func (d *Daemon) watchCerts() {
+	for range time.Tick(certCheckInterval) {
+		if d.renewCerts() {
+			d.restartTLS()
+		}
+	}
+}
+
+// renewCerts reissues any certs which are expiring soon or were signed by a
+// different CAROOT. Returns true if any certs were renewed.
+func (d *Daemon) renewCerts() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	renewed := false
+	lh := d.loggedHandler
+
+	if d.needsRenewal(lh.defaultHost) {
+		cert, key, err := RenewCert(lh.defaultHost)
+		if err != nil {
+			fmt.Printf("[*] warning: failed to renew cert for %s: %s\n", lh.defaultHost, err)
+		} else {
+			lh.defaultCert, lh.defaultKey = cert, key
+			renewed = true
+		}
+	}
+
+	for _, vhost := range lh.vhostMux.Servers {
+		if vhost.Cert == "" || !d.needsRenewal(vhost.Host) {
+			continue
+		}
+		cert, key, err := RenewCert(vhost.Host)
+		if err != nil {
+			fmt.Printf("[*] warning: failed to renew cert for %s: %s\n", vhost.Host, err)
+			continue
+		}
+		vhost.Cert, vhost.Key = cert, key
+		renewed = true
+	}
+	if d.shareAliasCerts() {
+		renewed = true
+	}
+
+	if renewed {
+		d.saveVhosts()
+	}
+	return renewed
+}
+
+func (d *Daemon) needsRenewal(host string) bool {
+	info, err := InspectCert(host)
+	if err != nil {
+		fmt.Printf("[*] warning: failed to inspect cert for %s: %s\n", host, err)
+		return false
+	}
+	if !info.NeedsRenewal() {
+		return false
+	}
+	fmt.Printf("[*] renewing cert for %s (%s, expires %s)\n", host, info.Status(), info.NotAfter.Format("2006-01-02"))
+	return true
+}
@@ -1,6 +1,7 @@
 package vproxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -114,4 +115,95 @@ func TestAddRemoveVhost(t *testing.T) {
 	v := d.loggedHandler.GetVhost("foo")
 	d.doRemoveVhost(v, r)
 	assert.Equal(t, 0, len(lh.vhostMux.Servers))
+
+	// hostnames are used in file names, e.g. for logs
+	for _, binding := range []string{"../../etc/x:8000", "a/b.local:8000", "..:8000", "a..b:8000", ":8000"} {
+		r = httptest.NewRecorder()
+		d.addVhost(binding, r)
+		assert.Equal(t, http.StatusBadRequest, r.Code, binding)
+	}
+	assert.Equal(t, 0, len(lh.vhostMux.Servers))
+}
+
+// run with -race: cert renewal runs on its own goroutine while vhosts are
+// added and removed
+func TestRenewCertsConcurrently(t *testing.T) {
+	reset()
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			d.renewCerts()
+		}
+		close(done)
+	}()
+	for i := 0; i < 20; i++ {
+		host := fmt.Sprintf("renew%d.local", i)
+		d.addVhost(host+":8000", httptest.NewRecorder())
+		d.listClients(httptest.NewRecorder(), httptest.NewRequest("GET", "/_vproxy/clients", nil))
+		if v := lh.GetVhost(host); v != nil && i%2 == 0 {
+			d.doRemoveVhost(v, httptest.NewRecorder())
+		}
+	}
+	<-done
+	assert.Equal(t, 10, len(d.vhosts()))
+}
+
+func TestRenewCertFailure(t *testing.T) {
+	cert, key, err := MakeCert("keep.local")
+	assert.Nil(t, err)
+	before, err := os.ReadFile(cert)
+	assert.Nil(t, err)
+
+	issueCert = func([]string) (string, string, error) {
+		return "", "", fmt.Errorf("CA key unreadable")
+	}
+	_, _, err = RenewCert("keep.local")
+	issueCert = makeCert
+	assert.NotNil(t, err)
+
+	// the old pair is still in place and loadable
+	after, err := os.ReadFile(cert)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+	_, err = tls.LoadX509KeyPair(cert, key)
+	assert.Nil(t, err)
+
+	newCert, _, err := RenewCert("keep.local")
+	assert.Nil(t, err)
+	assert.Equal(t, cert, newCert)
+	after, _ = os.ReadFile(cert)
+	assert.NotEqual(t, before, after)
+	_, err = os.Stat(cert + ".old")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListPruneCerts(t *testing.T) {
+	reset()
+	vhostMux := CreateVhostMux([]string{}, true)
+	lh := NewLoggedHandler(vhostMux)
+	d := NewDaemon(lh, "", 0, 0)
+
+	d.addVhost("inuse.local:8000", httptest.NewRecorder())
+	_, _, err := MakeCert("inuse.local")
+	assert.Nil(t, err)
+	_, _, err = MakeCert("orphan.local")
+	assert.Nil(t, err)
+
+	r := httptest.NewRecorder()
+	d.listCerts(r, httptest.NewRequest("GET", "/_vproxy/certs", nil))
+	res := r.Body.String()
+	assert.Contains(t, res, "inuse.local")
+	assert.Contains(t, res, "orphaned")
+
+	r = httptest.NewRecorder()
+	d.pruneCerts(r, httptest.NewRequest("POST", "/_vproxy/certs/prune", nil))
+	assert.Contains(t, r.Body.String(), "removed cert: orphan.local")
+	assert.NotContains(t, r.Body.String(), "inuse.local")
+
+	info, err := InspectCert("inuse.local")
+	assert.Nil(t, err)
+	assert.False(t, info.NeedsRenewal())
 }
@@ -0,0 +1,140 @@
+package vproxy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// how long to wait when checking whether an upstream is reachable
+var reachableTimeout = 500 * time.Millisecond
+
+// VhostStatus is the state of a vhost, as shown in the dashboard
+type VhostStatus struct {
+	Host      string        `json:"host"`
+	Upstream  string        `json:"upstream"`
+	Reachable bool          `json:"reachable"`
+	Health    *HealthStatus `json:"health,omitempty"`
+	Listeners int           `json:"listeners"`
+	Options   VhostOptions  `json:"options"`
+	Cert      *CertInfo     `json:"cert,omitempty"`
+}
+
+// vhostStatuses for all vhosts, sorted by host. Upstreams are checked in
+// parallel.
+func (d *Daemon) vhostStatuses() []*VhostStatus {
+	statuses := []*VhostStatus{}
+	var wg sync.WaitGroup
+	for _, v := range d.vhosts() {
+		s := &VhostStatus{
+			Host:      v.Host,
+			Upstream:  v.upstream(),
+			Listeners: v.listenerCount(),
+			Options:   v.Options,
+		}
+		if health := v.Health(); health.State != "" {
+			s.Health = &health
+		}
+		if v.Cert != "" {
+			if cert, err := inspectCertFile(v.Host, v.Cert, v.Key); err == nil {
+				cert.InUse = true
+				s.Cert = cert
+			}
+		}
+		statuses = append(statuses, s)
+		if !v.Options.hasUpstream() {
+			s.Reachable = v.Options.Dir == "" || validateDir(v.Options.Dir) == nil
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := net.DialTimeout("tcp", s.Upstream, reachableTimeout); err == nil {
+				conn.Close()
+				s.Reachable = true
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+// serveDashboard handler for requests to the daemon's own hostname
+func (d *Daemon) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardHTML)
+}
+
+// dashboardLogs streams log entries for a vhost as server-sent events, each a
+// JSON-encoded LogEntry
+func (d *Daemon) dashboardLogs(w http.ResponseWriter, r *http.Request) {
+	vhost := d.loggedHandler.GetVhost(r.FormValue("host"))
+	if vhost == nil {
+		http.Error(w, "host not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := unwrapFlusher(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(entry *LogEntry) {
+		b, _ := json.Marshal(entry)
+		fmt.Fprintf(w, "data: %s\n\n", b)
+	}
+
+	logChan := vhost.NewLogListener()
+	defer vhost.RemoveLogListener(logChan)
+	for _, entry := range vhost.BufferedLogs() {
+		send(entry)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if vhost.isClosed() {
+				return
+			}
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case entry := <-logChan:
+			send(entry)
+			flusher.Flush()
+		}
+	}
+}
+
+// unwrapFlusher returns the http.Flusher for the writer, looking through the
+// LogRecord wrapper if needed
+func unwrapFlusher(w http.ResponseWriter) (http.Flusher, bool) {
+	if lr, ok := w.(*LogRecord); ok {
+		w = lr.ResponseWriter
+	}
+	f, ok := w.(http.Flusher)
+	return f, ok
+}
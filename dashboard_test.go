@@ -0,0 +1,81 @@
+package vproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboard(t *testing.T) {
+	reset()
+	upstream, port := startUpstream("X-Test")
+	defer upstream.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+	lh.HandleFunc("/_vproxy/clients", d.listClients)
+	lh.dashboard = http.HandlerFunc(d.serveDashboard)
+
+	up, err := CreateVhost(fmt.Sprintf("up.local:%d", port), false)
+	assert.Nil(t, err)
+	lh.AddVhost(up)
+	down, err := CreateVhost("down.local:1", false)
+	assert.Nil(t, err)
+	lh.AddVhost(down)
+
+	// page is served on the daemon's own hostname only
+	r := httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "https://vproxy.local/", nil))
+	assert.Equal(t, 200, r.Code)
+	assert.Contains(t, r.Body.String(), "<title>vproxy</title>")
+
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "https://vproxy.local/_vproxy/clients?format=json", nil))
+	assert.Equal(t, "application/json", r.Header().Get("Content-Type"))
+	statuses := []*VhostStatus{}
+	assert.Nil(t, json.Unmarshal(r.Body.Bytes(), &statuses))
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, "down.local", statuses[0].Host)
+	assert.False(t, statuses[0].Reachable)
+	assert.Equal(t, "up.local", statuses[1].Host)
+	assert.True(t, statuses[1].Reachable)
+}
+
+func TestDashboardLogs(t *testing.T) {
+	reset()
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+	vhost, err := CreateVhost("logs.local:1", false)
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+	vhost.PushLog(&LogEntry{Time: time.Now(), Vhost: "logs.local", Method: "GET", Path: "/old", Status: 200})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/_vproxy/dashboard/logs?host=logs.local", nil).WithContext(ctx)
+	r := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		d.dashboardLogs(r, req)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	vhost.PushLog(&LogEntry{Time: time.Now(), Vhost: "logs.local", Method: "GET", Path: "/new", Status: 404})
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, "text/event-stream", r.Header().Get("Content-Type"))
+	events := strings.Split(strings.TrimSpace(r.Body.String()), "\n\n")
+	assert.Equal(t, 2, len(events))
+	assert.Contains(t, events[0], `"path":"/old"`)
+	assert.Contains(t, events[1], `"path":"/new"`)
+}
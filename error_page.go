@@ -0,0 +1,165 @@
+package vproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Kinds of error pages, also used as template file names (e.g.,
+// upstream_down.html) and the "error" field of JSON errors
+const (
+	ErrorUnknownHost     = "unknown_host"
+	ErrorNotFound        = "not_found"
+	ErrorUpstreamDown    = "upstream_down"
+	ErrorUpstreamTimeout = "upstream_timeout"
+	ErrorPanic           = "panic"
+)
+
+// HeaderError is set on all error responses generated by vproxy, so they can
+// be told apart from the upstream's own
+const HeaderError = "X-Vproxy-Error"
+
+// ErrorPage is the data passed to error page templates
+type ErrorPage struct {
+	Kind      string `json:"error"`
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	Host      string `json:"host"`
+	Upstream  string `json:"upstream,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// seconds until the page reloads itself; 0 to disable
+	Refresh int `json:"-"`
+}
+
+// Title for the page, e.g. "503 Service Unavailable"
+func (p *ErrorPage) Title() string {
+	return fmt.Sprintf("%d %s", p.Status, http.StatusText(p.Status))
+}
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p><small>request id: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// startingTemplate is shown while an upstream is down; it polls the page and
+// reloads once the response no longer comes from vproxy itself
+var startingTemplate = template.Must(template.New("starting").Parse(`<html>
+<head>
+<title>Waiting for {{.Host}}</title>
+<noscript><meta http-equiv="refresh" content="{{.Refresh}}"></noscript>
+</head>
+<body>
+<h1>Waiting for {{.Host}} to start&hellip;</h1>
+<p>{{.Message}}</p>
+<p>This page will reload automatically when the service comes up.</p>
+<script>
+setInterval(function () {
+  fetch(location.href, { method: "HEAD", cache: "no-store" }).then(function (res) {
+    if (!res.headers.get("{{.Header}}")) location.reload();
+  }).catch(function () {});
+}, {{.Refresh}} * 1000);
+</script>
+</body>
+</html>
+`))
+
+// template for the page, from the given dir if it has one. Files are parsed
+// on every request so that edits show up immediately. They are read with the
+// same restrictions as static vhosts, as the dir may be given by any user.
+func (p *ErrorPage) template(dir string) *template.Template {
+	if dir != "" {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		root := staticFS{root: dir, worldReadable: staticWorldReadable}
+		for _, name := range []string{p.Kind + ".html", "error.html"} {
+			t, err := loadErrorTemplate(root, name)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				fmt.Printf("[*] warning: failed to load error page %s: %s\n", filepath.Join(dir, name), err)
+				break
+			}
+			return t
+		}
+	}
+	if p.Kind == ErrorUpstreamDown && p.Refresh > 0 {
+		return startingTemplate
+	}
+	return defaultErrorTemplate
+}
+
+func loadErrorTemplate(root staticFS, name string) (*template.Template, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(name).Parse(string(b))
+}
+
+// render the page as JSON or HTML, depending on what the client accepts
+func (p *ErrorPage) render(r *http.Request, dir string) (header http.Header, body []byte) {
+	header = http.Header{}
+	header.Set(HeaderError, p.Kind)
+	header.Set("Cache-Control", "no-store")
+	if p.Refresh > 0 {
+		header.Set("Retry-After", strconv.Itoa(p.Refresh))
+	}
+
+	if wantsJSON(r) {
+		header.Set("Content-Type", "application/json")
+		body, _ = json.Marshal(p)
+		return header, append(body, '\n')
+	}
+
+	buf := &bytes.Buffer{}
+	data := struct {
+		*ErrorPage
+		Title  string
+		Header string
+	}{p, p.Title(), HeaderError}
+	if err := p.template(dir).Execute(buf, data); err != nil {
+		fmt.Printf("[*] warning: failed to render error page: %s\n", err)
+		buf.Reset()
+		defaultErrorTemplate.Execute(buf, data)
+	}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	return header, buf.Bytes()
+}
+
+// Serve the page
+func (p *ErrorPage) Serve(w http.ResponseWriter, r *http.Request, dir string) {
+	header, body := p.render(r, dir)
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// wantsJSON if the client accepts JSON but not HTML, e.g. API clients
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "text/html")
+}
@@ -0,0 +1,98 @@
+package vproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownHostPage(t *testing.T) {
+	mux := CreateVhostMux([]string{}, false)
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, httptest.NewRequest("GET", "http://nope.local/", nil))
+	assert.Equal(t, 404, r.Code)
+	assert.Equal(t, ErrorUnknownHost, r.Header().Get(HeaderError))
+	assert.Contains(t, r.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, r.Body.String(), "host not found: nope.local")
+
+	// API clients get JSON
+	req := httptest.NewRequest("GET", "http://nope.local/api", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(HeaderRequestID, "abc123")
+	r = httptest.NewRecorder()
+	mux.ServeHTTP(r, req)
+	assert.Equal(t, "application/json", r.Header().Get("Content-Type"))
+	page := &ErrorPage{}
+	assert.Nil(t, json.Unmarshal(r.Body.Bytes(), page))
+	assert.Equal(t, ErrorUnknownHost, page.Kind)
+	assert.Equal(t, 404, page.Status)
+	assert.Equal(t, "nope.local", page.Host)
+	assert.Equal(t, "abc123", page.RequestID)
+}
+
+func TestCustomErrorPages(t *testing.T) {
+	reset()
+	defer func(v bool) { staticWorldReadable = v }(staticWorldReadable)
+	staticWorldReadable = false
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "upstream_down.html"), []byte(`down: {{.Host}} {{.Status}}`), 0644)
+	os.WriteFile(filepath.Join(dir, "error.html"), []byte(`oops: {{.Title}}`), 0644)
+
+	vhost, err := CreateVhostWithOptions("pages.local:1", false, VhostOptions{ErrorPages: dir, RetryPolicy: RetryPolicy{RetryMaxAttempts: 1}})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	mux := &VhostMux{Servers: map[string]*Vhost{"pages.local": vhost}}
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, httptest.NewRequest("GET", "http://pages.local/", nil))
+	assert.Equal(t, 503, r.Code)
+	assert.Equal(t, "down: pages.local 503", r.Body.String())
+
+	// falls back to error.html
+	page := &ErrorPage{Kind: ErrorPanic, Status: 503}
+	_, body := page.render(httptest.NewRequest("GET", "/", nil), dir)
+	assert.Equal(t, "oops: 503 Service Unavailable", string(body))
+
+	// symlinks out of the dir aren't followed
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600)
+	os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "not_found.html"))
+	page = &ErrorPage{Kind: ErrorNotFound, Status: 404}
+	_, body = page.render(httptest.NewRequest("GET", "/", nil), dir)
+	assert.Equal(t, "oops: 404 Not Found", string(body))
+
+	// as root, only dirs and files which any user can read are used
+	staticWorldReadable = true
+	assert.NotNil(t, VhostOptions{ErrorPages: dir}.Validate()) // t.TempDir is 0700
+	os.Chmod(dir, 0755)
+	os.Chmod(filepath.Dir(dir), 0755)
+	assert.Nil(t, VhostOptions{ErrorPages: dir}.Validate())
+	os.Chmod(filepath.Join(dir, "error.html"), 0600)
+	_, body = page.render(httptest.NewRequest("GET", "/", nil), dir)
+	assert.NotContains(t, string(body), "oops")
+}
+
+func TestUpstreamErrorPage(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5000/", nil)
+	page := upstreamErrorPage("app.local", req, &timeoutError{})
+	assert.Equal(t, ErrorUpstreamTimeout, page.Kind)
+	assert.Equal(t, http.StatusGatewayTimeout, page.Status)
+
+	page = upstreamErrorPage("app.local", req, os.ErrNotExist)
+	assert.Equal(t, ErrorUpstreamDown, page.Kind)
+	header, body := page.render(req, "")
+	assert.Equal(t, "2", header.Get("Retry-After"))
+	assert.Contains(t, string(body), "Waiting for app.local to start")
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,205 @@
+package vproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published by the daemon
+const (
+	EventVhostAdded    = "vhost.added"
+	EventVhostRemoved  = "vhost.removed"
+	EventVhostReplaced = "vhost.replaced"
+	EventUpstreamError = "upstream.error"
+	EventUpstreamDown  = "upstream.down"
+	EventUpstreamUp    = "upstream.up"
+	EventCertIssued    = "cert.issued"
+	EventHostsUpdated  = "hosts.updated"
+)
+
+// EventTypes lists all event types, for validating filters
+var EventTypes = []string{
+	EventVhostAdded, EventVhostRemoved, EventVhostReplaced,
+	EventUpstreamError, EventUpstreamDown, EventUpstreamUp,
+	EventCertIssued, EventHostsUpdated,
+}
+
+// Event is a change in the daemon's state, sent to /_vproxy/events listeners
+// and webhooks
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	CertFile string    `json:"cert_file,omitempty"`
+}
+
+// eventBus fans out events to subscribers; slow subscribers miss events rather
+// than blocking the publisher
+type eventBus struct {
+	mu          sync.Mutex
+	seq         uint64
+	subscribers map[chan *Event]bool
+}
+
+// events is shared by the daemon, proxy transports and cert issuance
+var events = newEventBus()
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: map[chan *Event]bool{}}
+}
+
+func (b *eventBus) subscribe() chan *Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan *Event, 100)
+	b.subscribers[ch] = true
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// publish the event, setting its ID and time
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.ID = b.seq
+	e.Time = time.Now()
+	for ch := range b.subscribers {
+		select {
+		case ch <- &e:
+		default:
+		}
+	}
+}
+
+// parseEventTypes from a comma-separated list; empty means all types
+func parseEventTypes(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	types := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		valid := false
+		for _, et := range EventTypes {
+			valid = valid || t == et
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid event type '%s' (expected one of: %s)", t, strings.Join(EventTypes, ", "))
+		}
+		types[t] = true
+	}
+	return types, nil
+}
+
+// streamEvents to the client as server-sent events, optionally limited to the
+// given types
+func (d *Daemon) streamEvents(w http.ResponseWriter, r *http.Request) {
+	types, err := parseEventTypes(r.FormValue("type"))
+	if err != nil {
+		http.Error(w, "error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := unwrapFlusher(w)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case e := <-ch:
+			if types != nil && !types[e.Type] {
+				continue
+			}
+			b, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+			flusher.Flush()
+		}
+	}
+}
+
+// webhook delivers events to a URL as JSON POSTs
+type webhook struct {
+	url    string
+	client *http.Client
+	ch     chan *Event
+}
+
+// AddWebhook posts every event to the given URL
+func (d *Daemon) AddWebhook(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url: '%s'", rawURL)
+	}
+	hook := &webhook{
+		url:    rawURL,
+		client: &http.Client{Timeout: 5 * time.Second},
+		ch:     events.subscribe(),
+	}
+	go hook.run()
+	return nil
+}
+
+func (h *webhook) run() {
+	for e := range h.ch {
+		h.send(e)
+	}
+}
+
+func (h *webhook) send(e *Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(b))
+	if err != nil {
+		fmt.Printf("[*] warning: failed to send webhook to %s: %s\n", h.url, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vproxy/"+Version)
+	req.Header.Set("X-Vproxy-Event", e.Type)
+	res, err := h.client.Do(req)
+	if err != nil {
+		fmt.Printf("[*] warning: failed to send webhook to %s: %s\n", h.url, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		fmt.Printf("[*] warning: failed to send webhook to %s: %s\n", h.url, res.Status)
+	}
+}
@@ -0,0 +1,84 @@
+package vproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventWebhook(t *testing.T) {
+	reset()
+	received := make(chan *Event, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &Event{}
+		json.NewDecoder(r.Body).Decode(e)
+		assert.Equal(t, e.Type, r.Header.Get("X-Vproxy-Event"))
+		received <- e
+	}))
+	defer hook.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+	assert.NotNil(t, d.AddWebhook("ftp://example.com"))
+	assert.Nil(t, d.AddWebhook(hook.URL))
+
+	d.addVhost("hook.local:8000", httptest.NewRecorder())
+	d.addVhost("hook.local:8001", httptest.NewRecorder())
+	d.doRemoveVhost(lh.GetVhost("hook.local"), httptest.NewRecorder())
+
+	next := func(typ string) *Event {
+		for {
+			select {
+			case e := <-received:
+				if e.Type == typ {
+					return e
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timed out waiting for %s event", typ)
+				return nil
+			}
+		}
+	}
+	e := next(EventVhostAdded)
+	assert.Equal(t, "hook.local", e.Host)
+	assert.Equal(t, "127.0.0.1:8000", e.Upstream)
+	assert.Equal(t, "127.0.0.1:8001", next(EventVhostReplaced).Upstream)
+	assert.Equal(t, "hook.local", next(EventVhostRemoved).Host)
+}
+
+func TestStreamEvents(t *testing.T) {
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+
+	r := httptest.NewRecorder()
+	d.streamEvents(r, httptest.NewRequest("GET", "/_vproxy/events?type=bogus", nil))
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/_vproxy/events?type=upstream.error", nil).WithContext(ctx)
+	r = httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		d.streamEvents(r, req)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	events.publish(Event{Type: EventVhostAdded, Host: "skipped.local"})
+	events.publish(Event{Type: EventUpstreamError, Host: "down.local", Upstream: "127.0.0.1:1", Error: "connection refused"})
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, "text/event-stream", r.Header().Get("Content-Type"))
+	body := r.Body.String()
+	assert.False(t, strings.Contains(body, "skipped.local"))
+	assert.Contains(t, body, "event: upstream.error\n")
+	assert.Contains(t, body, `"host":"down.local","upstream":"127.0.0.1:1","error":"connection refused"`)
+}
@@ -0,0 +1,165 @@
+package vproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedPolicy controls how forwarded headers sent by the client are
+// treated. By default they are overwritten, so that a client can't spoof its
+// address or scheme; in "append" mode, headers from trusted proxies (e.g., a
+// local tunnel) are kept and this hop is appended.
+type ForwardedPolicy struct {
+	ForwardedMode  string   `json:"forwarded_mode,omitempty"`  // "overwrite" (default) or "append"
+	TrustedProxies []string `json:"trusted_proxies,omitempty"` // client IPs or CIDRs (default: loopback)
+}
+
+// Forwarded modes
+const (
+	ForwardedOverwrite = "overwrite"
+	ForwardedAppend    = "append"
+)
+
+// clients trusted in append mode unless configured
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// headers describing the client, dropped when sent by an untrusted client
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Port",
+	"X-Real-Ip",
+}
+
+// Validate the policy
+func (p ForwardedPolicy) Validate() error {
+	switch p.ForwardedMode {
+	case "", ForwardedOverwrite, ForwardedAppend:
+	default:
+		return fmt.Errorf("invalid forwarded mode '%s' (expected 'overwrite' or 'append')", p.ForwardedMode)
+	}
+	_, err := parseCIDRs(p.TrustedProxies)
+	return err
+}
+
+// parseCIDRs in the form "10.0.0.0/8" or a single IP
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// forwarder sets the forwarded headers on requests sent upstream
+type forwarder struct {
+	appendMode bool
+	trusted    []*net.IPNet
+}
+
+func newForwarder(p ForwardedPolicy) *forwarder {
+	list := p.TrustedProxies
+	if len(list) == 0 {
+		list = defaultTrustedProxies
+	}
+	// validated along with the options
+	trusted, _ := parseCIDRs(list)
+	return &forwarder{appendMode: p.ForwardedMode == ForwardedAppend, trusted: trusted}
+}
+
+// trusts the client's forwarded headers
+func (f *forwarder) trusts(clientIP string) bool {
+	if !f.appendMode {
+		return false
+	}
+	ip := net.ParseIP(clientIP)
+	for _, n := range f.trusted {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders describing the client request on the outgoing request, given the
+// Host the client asked for. X-Forwarded-For is appended to by the
+// ReverseProxy itself.
+func (f *forwarder) setHeaders(r *http.Request, host string) {
+	clientIP := r.RemoteAddr
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = ip
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	port := localPort(r)
+	if port == "" {
+		if _, p, err := net.SplitHostPort(host); err == nil {
+			port = p
+		} else if proto == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+
+	var prior []string
+	if f.trusts(clientIP) {
+		prior = r.Header.Values("Forwarded")
+	} else {
+		for _, name := range forwardedHeaders {
+			r.Header.Del(name)
+		}
+	}
+
+	// the first proxy describes the original request; later ones keep it
+	setDefault := func(name, value string) {
+		if r.Header.Get(name) == "" {
+			r.Header.Set(name, value)
+		}
+	}
+	setDefault("X-Forwarded-Host", host)
+	setDefault("X-Forwarded-Proto", proto)
+	setDefault("X-Forwarded-Port", port)
+	realIP := clientIP
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		realIP, _, _ = strings.Cut(xff, ",")
+	}
+	setDefault("X-Real-Ip", strings.TrimSpace(realIP))
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedValue(forwardedNode(clientIP)), forwardedValue(host), proto)
+	r.Header.Set("Forwarded", strings.Join(append(prior, element), ", "))
+}
+
+// forwardedNode formats an IP as an RFC 7239 node (IPv6 in brackets)
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// forwardedValue quotes the value unless it is a valid token
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, `:[]",;= `) {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package vproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startHeaderEcho returns the forwarded headers received by the upstream as JSON
+func startHeaderEcho() (*httptest.Server, int) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := map[string]string{"Host": r.Host}
+		for _, name := range forwardedHeaders {
+			h[name] = r.Header.Get(name)
+		}
+		json.NewEncoder(w).Encode(h)
+	}))
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return upstream, port
+}
+
+func getForwarded(t *testing.T, client *http.Client, rawURL string, host string) map[string]string {
+	req, _ := http.NewRequest("GET", rawURL, nil)
+	req.Host = host
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	req.Header.Set("X-Forwarded-Host", "evil.example")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Real-IP", "6.6.6.6")
+	req.Header.Set("Forwarded", "for=6.6.6.6")
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	h := map[string]string{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&h))
+	return h
+}
+
+func TestForwardedHeadersHTTP(t *testing.T) {
+	reset()
+	upstream, port := startHeaderEcho()
+	defer upstream.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, false))
+	vhost, err := CreateVhostWithOptions(fmt.Sprintf("fwd.local:%d", port), false, VhostOptions{})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+
+	server := httptest.NewServer(lh)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	h := getForwarded(t, http.DefaultClient, server.URL, "fwd.local")
+	assert.Equal(t, "fwd.local", h["Host"])
+	assert.Equal(t, "127.0.0.1", h["X-Forwarded-For"])
+	assert.Equal(t, "fwd.local", h["X-Forwarded-Host"])
+	assert.Equal(t, "http", h["X-Forwarded-Proto"])
+	assert.Equal(t, u.Port(), h["X-Forwarded-Port"])
+	assert.Equal(t, "127.0.0.1", h["X-Real-Ip"])
+	assert.Equal(t, "for=127.0.0.1;host=fwd.local;proto=http", h["Forwarded"])
+}
+
+func TestForwardedHeadersHTTPS(t *testing.T) {
+	reset()
+	upstream, port := startHeaderEcho()
+	defer upstream.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	vhost, err := CreateVhostWithOptions(fmt.Sprintf("fwd.local:%d", port), true, VhostOptions{})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+
+	server := httptest.NewUnstartedServer(lh)
+	server.TLS = lh.CreateTLSConfig()
+	server.StartTLS()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	ca, _ := loadCACert()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "fwd.local"}}}
+
+	h := getForwarded(t, client, server.URL, "fwd.local:"+u.Port())
+	assert.Equal(t, "127.0.0.1", h["X-Forwarded-For"])
+	assert.Equal(t, "fwd.local:"+u.Port(), h["X-Forwarded-Host"])
+	assert.Equal(t, "https", h["X-Forwarded-Proto"])
+	assert.Equal(t, u.Port(), h["X-Forwarded-Port"])
+	assert.Equal(t, "127.0.0.1", h["X-Real-Ip"])
+	assert.Equal(t, fmt.Sprintf(`for=127.0.0.1;host="fwd.local:%s";proto=https`, u.Port()), h["Forwarded"])
+}
+
+func TestForwardedAppend(t *testing.T) {
+	reset()
+	upstream, _ := startHeaderEcho()
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	// httptest requests come from 192.0.2.1
+	serve := func(policy ForwardedPolicy) map[string]string {
+		proxy := CreateProxyWithOptions(*u, "fwd.local", VhostOptions{ForwardedPolicy: policy})
+		req := httptest.NewRequest("GET", "http://fwd.local/", nil)
+		req.Header.Set("X-Forwarded-For", "6.6.6.6")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=6.6.6.6;proto=https")
+		r := httptest.NewRecorder()
+		proxy.ServeHTTP(r, req)
+		h := map[string]string{}
+		assert.Nil(t, json.Unmarshal(r.Body.Bytes(), &h))
+		return h
+	}
+
+	h := serve(ForwardedPolicy{ForwardedMode: ForwardedAppend, TrustedProxies: []string{"192.0.2.0/24"}})
+	assert.Equal(t, "6.6.6.6, 192.0.2.1", h["X-Forwarded-For"])
+	assert.Equal(t, "https", h["X-Forwarded-Proto"])
+	assert.Equal(t, "6.6.6.6", h["X-Real-Ip"])
+	assert.Equal(t, "fwd.local", h["X-Forwarded-Host"])
+	assert.Equal(t, "for=6.6.6.6;proto=https, for=192.0.2.1;host=fwd.local;proto=http", h["Forwarded"])
+
+	// not a trusted proxy (default: loopback only)
+	h = serve(ForwardedPolicy{ForwardedMode: ForwardedAppend})
+	assert.Equal(t, "192.0.2.1", h["X-Forwarded-For"])
+	assert.Equal(t, "http", h["X-Forwarded-Proto"])
+	assert.Equal(t, "80", h["X-Forwarded-Port"])
+	assert.Equal(t, "for=192.0.2.1;host=fwd.local;proto=http", h["Forwarded"])
+
+	assert.Nil(t, ForwardedPolicy{TrustedProxies: []string{"10.0.0.0/8", "::1", "172.16.0.1"}}.Validate())
+	assert.NotNil(t, ForwardedPolicy{TrustedProxies: []string{"10.0.0.0/33"}}.Validate())
+	assert.NotNil(t, ForwardedPolicy{ForwardedMode: "replace"}.Validate())
+}
@@ -5,14 +5,18 @@ go 1.23
 toolchain go1.23.4
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/cenkalti/backoff/v4 v4.3.0
 	github.com/gammazero/deque v1.0.0
 	github.com/jittering/truststore v1.4.4-lib.0.20220731155747-7bcc05146bce
+	github.com/klauspost/compress v1.17.11
 	github.com/mattn/go-isatty v0.0.20
 	github.com/pelletier/go-toml v1.9.5
 	github.com/shirou/gopsutil v3.21.11+incompatible
+	github.com/stretchr/testify v1.2.2
 	github.com/txn2/txeh v1.5.5
 	github.com/urfave/cli/v2 v2.27.5
+	golang.org/x/crypto v0.32.0
 )
 
 require (
@@ -21,12 +25,10 @@ require (
 	github.com/go-ole/go-ole v1.3.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	github.com/stretchr/testify v1.2.2 // indirect
 	github.com/tklauser/go-sysconf v0.3.14 // indirect
 	github.com/tklauser/numcpus v0.9.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
@@ -0,0 +1,426 @@
+package vproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version of vproxy, reported in HAR exports
+var Version = "n/a"
+
+// HAR 1.2 types, see http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings in milliseconds; -1 means not applicable
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// NewHAR containing the given exchanges
+func NewHAR(exchanges []*Exchange) *HAR {
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "vproxy", Version: Version},
+		Entries: []HAREntry{},
+	}}
+	for _, ex := range exchanges {
+		har.Log.Entries = append(har.Log.Entries, ex.HAREntry())
+	}
+	return har
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// optMs returns -1 for timings which did not apply (e.g., reused connections)
+func optMs(d time.Duration) float64 {
+	if d == 0 {
+		return -1
+	}
+	return ms(d)
+}
+
+// HAREntry for the exchange
+func (ex *Exchange) HAREntry() HAREntry {
+	req := ex.Request
+	scheme := "http"
+	if req.TLS != "" {
+		scheme = "https"
+	}
+	u := &url.URL{Scheme: scheme, Host: req.Host}
+	if ru, err := url.ParseRequestURI(req.URI); err == nil {
+		u.Path, u.RawPath, u.RawQuery = ru.Path, ru.RawPath, ru.RawQuery
+	}
+
+	entry := HAREntry{
+		StartedDateTime: ex.Time.Add(-ex.Duration),
+		Time:            ms(ex.Duration),
+		Request: HARRequest{
+			Method:      req.Method,
+			URL:         u.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies((&http.Request{Header: req.Header}).Cookies()),
+			Headers:     harHeaders(req.Header, req.Host),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    req.BodySize,
+		},
+		Timings: HARTimings{Blocked: -1, DNS: -1, Connect: -1, Send: 0, Wait: ms(ex.Duration), Receive: 0, SSL: -1},
+	}
+	for k, vals := range u.Query() {
+		for _, v := range vals {
+			entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{k, v})
+		}
+	}
+	if req.BodySize > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(req.Body),
+		}
+		if req.Truncated {
+			entry.Request.PostData.Comment = fmt.Sprintf("truncated, %d bytes total", req.BodySize)
+		}
+	}
+
+	if res := ex.Response; res != nil {
+		entry.Response = HARResponse{
+			Status:      res.Status,
+			StatusText:  http.StatusText(res.Status),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies((&http.Response{Header: res.Header}).Cookies()),
+			Headers:     harHeaders(res.Header, ""),
+			Content:     harContent(res),
+			RedirectURL: res.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    res.BodySize,
+		}
+	}
+
+	if t := ex.Timings; t != nil {
+		entry.Timings = HARTimings{
+			Blocked: optMs(t.Blocked),
+			DNS:     optMs(t.DNS),
+			Connect: optMs(t.Connect),
+			Send:    ms(t.Send),
+			Wait:    ms(t.Wait),
+			Receive: ms(t.Receive),
+			SSL:     optMs(t.TLS),
+		}
+		entry.ServerIPAddress, _, _ = net.SplitHostPort(t.ServerAddr)
+		if t.Retries > 0 {
+			entry.Comment = fmt.Sprintf("retried %d times", t.Retries)
+		}
+	}
+	if ex.ReplayOf != "" {
+		entry.Comment = strings.TrimPrefix(entry.Comment+"; replay of #"+ex.ReplayOf, "; ")
+	}
+	return entry
+}
+
+func harHeaders(h http.Header, host string) []HARNameValue {
+	headers := []HARNameValue{}
+	if host != "" {
+		headers = append(headers, HARNameValue{"Host", host})
+	}
+	for k, vals := range h {
+		for _, v := range vals {
+			headers = append(headers, HARNameValue{k, v})
+		}
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []HARCookie {
+	c := []HARCookie{}
+	for _, cookie := range cookies {
+		hc := HARCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			hc.Expires = &cookie.Expires
+		}
+		c = append(c, hc)
+	}
+	return c
+}
+
+func harContent(res *CapturedResponse) HARContent {
+	content := HARContent{
+		Size:     res.BodySize,
+		MimeType: res.Header.Get("Content-Type"),
+	}
+	switch {
+	case !res.Captured:
+		if res.BodySize > 0 {
+			content.Comment = "body not captured"
+		}
+		return content
+	case res.Header.Get("Content-Encoding") == "" && isTextBody(content.MimeType, res.Body):
+		content.Text = string(res.Body)
+	default:
+		content.Text = base64.StdEncoding.EncodeToString(res.Body)
+		content.Encoding = "base64"
+	}
+	if res.Truncated {
+		content.Comment = fmt.Sprintf("truncated to %d bytes", len(res.Body))
+	}
+	return content
+}
+
+// exportHAR handler returns the retained exchanges for a vhost as HAR
+func (d *Daemon) exportHAR(w http.ResponseWriter, r *http.Request) {
+	vhost, ok := d.inspectVhost(w, r)
+	if !ok {
+		return
+	}
+
+	var since time.Time
+	if s := r.FormValue("since"); s != "" {
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid since '%s': %s\n", s, err)
+			return
+		}
+		since = time.Now().Add(-dur)
+	}
+
+	exchanges := []*Exchange{}
+	for _, ex := range vhost.exchanges.List() {
+		if !ex.Time.Before(since) {
+			exchanges = append(exchanges, ex)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(NewHAR(exchanges))
+}
+
+// HARPath is the daemon-owned dir where HAR files for --har-file are written
+func HARPath() string {
+	return filepath.Join(CertPath(), "har")
+}
+
+// validateHARFile name, which must be a plain file name rather than a path,
+// as files are written by the daemon (possibly as root)
+func validateHARFile(name string) error {
+	if name == "" {
+		return nil
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid HAR file '%s' (expected a file name, e.g. out.har, written to %s)", name, HARPath())
+	}
+	return nil
+}
+
+// harFile continuously appends entries to a file, either as a HAR document or,
+// for .ndjson/.jsonl files, as one entry per line
+type harFile struct {
+	mu      sync.Mutex
+	path    string
+	ndjson  bool
+	entries bool // whether the HAR document already has entries
+}
+
+var (
+	harFilesMu sync.Mutex
+	harFiles   = map[string]*harFile{}
+)
+
+const harTrailer = "\n]}}\n"
+
+// appendHAR writes the exchange to the named file in HARPath. Files are shared
+// between vhosts writing to the same name.
+func appendHAR(name string, ex *Exchange) {
+	path := filepath.Join(HARPath(), filepath.Base(name))
+	harFilesMu.Lock()
+	f := harFiles[path]
+	if f == nil {
+		ext := strings.ToLower(filepath.Ext(path))
+		f = &harFile{path: path, ndjson: ext == ".ndjson" || ext == ".jsonl"}
+		harFiles[path] = f
+	}
+	harFilesMu.Unlock()
+
+	if err := f.append(ex.HAREntry()); err != nil {
+		fmt.Printf("[*] warning: failed to write HAR file %s: %s\n", path, err)
+	}
+}
+
+func (h *harFile) append(entry HAREntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return err
+	}
+
+	if h.ndjson {
+		f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(append(b, '\n'))
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := h.prepare(f); err != nil {
+		return err
+	}
+
+	// overwrite the trailer with the new entry, then put it back
+	sep := ""
+	if h.entries {
+		sep = ",\n"
+	}
+	if _, err := f.Seek(-int64(len(harTrailer)), io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := f.WriteString(sep + string(b) + harTrailer); err != nil {
+		return err
+	}
+	h.entries = true
+	return nil
+}
+
+// prepare writes the HAR header to a new file, or checks that an existing one
+// can be appended to
+func (h *harFile) prepare(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		header, _ := json.Marshal(HARLog{Version: "1.2", Creator: HARCreator{Name: "vproxy", Version: Version}})
+		// drop the null entries and the closing brace, to be replaced by the list
+		prefix := strings.TrimSuffix(string(header), `"entries":null}`)
+		_, err := f.WriteString(`{"log":` + prefix + `"entries":[` + harTrailer)
+		h.entries = false
+		return err
+	}
+
+	tail := make([]byte, len(harTrailer)+1)
+	if info.Size() < int64(len(tail)) {
+		return fmt.Errorf("not a HAR file written by vproxy")
+	}
+	if _, err := f.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(tail, []byte(harTrailer)) {
+		return fmt.Errorf("not a HAR file written by vproxy")
+	}
+	h.entries = tail[0] != '['
+	return nil
+}
@@ -0,0 +1,66 @@
+package vproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportHAR(t *testing.T) {
+	reset()
+	upstream, port := startUpstream("Content-Type")
+	defer upstream.Close()
+
+	harFile := filepath.Join(HARPath(), "out.har")
+	os.Remove(harFile)
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+	vhost, err := CreateVhostWithOptions(fmt.Sprintf("har.local:%d", port), false, VhostOptions{HARFile: "out.har"})
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "http://har.local/api?n="+fmt.Sprint(i), strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Cookie", "session=abc")
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	r := httptest.NewRecorder()
+	form := url.Values{"host": {"har.local"}, "since": {"1m"}}
+	d.exportHAR(r, httptest.NewRequest("POST", "/_vproxy/har?"+form.Encode(), nil))
+	har := &HAR{}
+	assert.Nil(t, json.Unmarshal(r.Body.Bytes(), har))
+	assert.Equal(t, "1.2", har.Log.Version)
+	assert.Equal(t, 2, len(har.Log.Entries))
+
+	e := har.Log.Entries[1]
+	assert.Equal(t, "http://har.local/api?n=1", e.Request.URL)
+	assert.Equal(t, []HARNameValue{{"n", "1"}}, e.Request.QueryString)
+	assert.Equal(t, 0, len(e.Request.Cookies)) // redacted
+	assert.Contains(t, e.Request.Headers, HARNameValue{"Cookie", "[redacted]"})
+	assert.Equal(t, "{}", e.Request.PostData.Text)
+	assert.Equal(t, 200, e.Response.Status)
+	assert.Equal(t, "127.0.0.1", e.ServerIPAddress)
+	assert.True(t, e.Timings.Wait > 0)
+
+	// continuously written file is a valid HAR document
+	b, err := os.ReadFile(harFile)
+	assert.Nil(t, err)
+	har = &HAR{}
+	assert.Nil(t, json.Unmarshal(b, har))
+	assert.Equal(t, 2, len(har.Log.Entries))
+	assert.Equal(t, "http://har.local/api?n=0", har.Log.Entries[0].Request.URL)
+
+	// only written to the daemon's own dir
+	for _, name := range []string{"../out.har", "/tmp/out.har", ".."} {
+		assert.NotNil(t, VhostOptions{HARFile: name}.Validate(), name)
+	}
+}
@@ -0,0 +1,78 @@
+package vproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// headerRule sets, adds or removes a single header. Rules are written as
+// "Name: value" (set), "+Name: value" (add) or "-Name" (remove).
+type headerRule struct {
+	op    byte // '=', '+' or '-'
+	name  string
+	value string
+}
+
+func parseHeaderRule(s string) (headerRule, error) {
+	rule := headerRule{op: '='}
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		rule.op, s = s[0], s[1:]
+	}
+
+	name, value, found := strings.Cut(s, ":")
+	rule.name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+	rule.value = strings.TrimSpace(value)
+	if rule.name == "" || strings.ContainsAny(rule.name, " \t") {
+		return rule, fmt.Errorf("invalid header rule '%s' (expected 'Name: value', '+Name: value' or '-Name')", s)
+	}
+	if rule.op == '-' && found {
+		return rule, fmt.Errorf("invalid header rule '-%s' (remove takes no value)", s)
+	}
+	if rule.op != '-' && !found {
+		return rule, fmt.Errorf("invalid header rule '%s' (missing ': value')", s)
+	}
+	return rule, nil
+}
+
+func parseHeaderRules(rules []string) ([]headerRule, error) {
+	parsed := make([]headerRule, 0, len(rules))
+	for _, s := range rules {
+		rule, err := parseHeaderRule(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// applyHeaderRules to the given headers, expanding placeholders from the
+// (client) request
+func applyHeaderRules(h http.Header, rules []headerRule, r *http.Request) {
+	if len(rules) == 0 {
+		return
+	}
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+	placeholders := strings.NewReplacer(
+		"{host}", getHostName(r.Host),
+		"{remote_addr}", remoteIP,
+		"{request_id}", r.Header.Get(HeaderRequestID),
+	)
+	for _, rule := range rules {
+		switch rule.op {
+		case '-':
+			h.Del(rule.name)
+		case '+':
+			h.Add(rule.name, placeholders.Replace(rule.value))
+		default:
+			h.Set(rule.name, placeholders.Replace(rule.value))
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package vproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeaderRule(t *testing.T) {
+	rule, err := parseHeaderRule("x-auth: Bearer {request_id}")
+	assert.Nil(t, err)
+	assert.Equal(t, headerRule{op: '=', name: "X-Auth", value: "Bearer {request_id}"}, rule)
+
+	rule, err = parseHeaderRule("+Cache-Control: no-store, no-cache")
+	assert.Nil(t, err)
+	assert.Equal(t, headerRule{op: '+', name: "Cache-Control", value: "no-store, no-cache"}, rule)
+
+	rule, err = parseHeaderRule("-Server")
+	assert.Nil(t, err)
+	assert.Equal(t, headerRule{op: '-', name: "Server"}, rule)
+
+	_, err = parseHeaderRule("X-Missing-Value")
+	assert.NotNil(t, err)
+	_, err = parseHeaderRule("-Server: nginx")
+	assert.NotNil(t, err)
+	assert.NotNil(t, VhostOptions{ResponseHeaders: []string{": nope"}}.Validate())
+}
+
+func TestHeaderRules(t *testing.T) {
+	reset()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "gunicorn")
+		w.Header().Set("X-Upstream", "yes")
+		fmt.Fprintf(w, "auth=%s debug=%s client=%s", r.Header.Get("X-Auth"), r.Header.Get("X-Debug"), r.Header.Get("X-Client"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, false))
+	vhost, err := CreateVhostWithOptions("headers.local:"+u.Port(), false, VhostOptions{
+		RequestHeaders:  []string{"X-Auth: token-for-{host}", "-X-Debug", "X-Client: {remote_addr}"},
+		ResponseHeaders: []string{"-Server", "Cache-Control: no-store", "+X-Upstream: vproxy", "X-Request: {request_id}"},
+	})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+
+	req := httptest.NewRequest("GET", "http://headers.local/", nil)
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set(HeaderRequestID, "req-1")
+	r := httptest.NewRecorder()
+	lh.ServeHTTP(r, req)
+
+	assert.Equal(t, "auth=token-for-headers.local debug= client=192.0.2.1", r.Body.String())
+	assert.Equal(t, "", r.Header().Get("Server"))
+	assert.Equal(t, "no-store", r.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"yes", "vproxy"}, r.Header()["X-Upstream"])
+	assert.Equal(t, "req-1", r.Header().Get("X-Request"))
+}
@@ -0,0 +1,253 @@
+package vproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthPolicy configures active health checks of a vhost's upstream. Empty
+// values use the defaults below.
+type HealthPolicy struct {
+	HealthCheck        *bool  `json:"health_check,omitempty"`        // default: only if a path is set
+	HealthPath         string `json:"health_path,omitempty"`         // HTTP GET path; TCP connect if empty
+	HealthInterval     string `json:"health_interval,omitempty"`     // e.g. "5s"
+	HealthyThreshold   int    `json:"healthy_threshold,omitempty"`   // consecutive successes to mark up
+	UnhealthyThreshold int    `json:"unhealthy_threshold,omitempty"` // consecutive failures to mark down
+}
+
+// Health check defaults
+var (
+	defaultHealthInterval     = 5 * time.Second
+	defaultHealthyThreshold   = 1
+	defaultUnhealthyThreshold = 2
+
+	// how often to check a down upstream, so that recovery is noticed quickly
+	healthRecoveryInterval = time.Second
+	// max time to wait for a single check
+	healthCheckTimeout = 2 * time.Second
+)
+
+// Upstream health states
+const (
+	HealthUnknown = "unknown"
+	HealthUp      = "up"
+	HealthDown    = "down"
+)
+
+// Validate the policy
+func (p HealthPolicy) Validate() error {
+	if p.HealthInterval != "" {
+		if d, err := time.ParseDuration(p.HealthInterval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid health check interval '%s'", p.HealthInterval)
+		}
+	}
+	if p.HealthPath != "" && !strings.HasPrefix(p.HealthPath, "/") {
+		return fmt.Errorf("invalid health check path '%s' (must start with /)", p.HealthPath)
+	}
+	if p.HealthyThreshold < 0 || p.UnhealthyThreshold < 0 {
+		return fmt.Errorf("invalid health check thresholds")
+	}
+	return nil
+}
+
+// enabled returns true if checks were turned on, either explicitly or by
+// giving a health check path. Off by default, as a down upstream gets a 503
+// without being tried.
+func (p HealthPolicy) enabled() bool {
+	if p.HealthCheck != nil {
+		return *p.HealthCheck
+	}
+	return p.HealthPath != ""
+}
+
+func (p HealthPolicy) interval() time.Duration {
+	if d, err := time.ParseDuration(p.HealthInterval); err == nil && d > 0 {
+		return d
+	}
+	return defaultHealthInterval
+}
+
+func (p HealthPolicy) healthyThreshold() int {
+	if p.HealthyThreshold > 0 {
+		return p.HealthyThreshold
+	}
+	return defaultHealthyThreshold
+}
+
+func (p HealthPolicy) unhealthyThreshold() int {
+	if p.UnhealthyThreshold > 0 {
+		return p.UnhealthyThreshold
+	}
+	return defaultUnhealthyThreshold
+}
+
+// HealthStatus of a vhost's upstream
+type HealthStatus struct {
+	State     string    `json:"state"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+	Since     time.Time `json:"since"` // time of the last state change
+}
+
+func (s HealthStatus) String() string {
+	if s.State == HealthDown && s.LastError != "" {
+		return fmt.Sprintf("%s: %s", s.State, s.LastError)
+	}
+	return s.State
+}
+
+// healthChecker periodically checks an upstream in the background
+type healthChecker struct {
+	host   string // vhost
+	addr   string // upstream host:port
+	policy HealthPolicy
+	client *http.Client
+
+	mu        sync.Mutex
+	status    HealthStatus
+	successes int
+	failures  int
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func newHealthChecker(host string, addr string, policy HealthPolicy) *healthChecker {
+	timeout := healthCheckTimeout
+	if policy.interval() < timeout {
+		timeout = policy.interval()
+	}
+	return &healthChecker{
+		host:   host,
+		addr:   addr,
+		policy: policy,
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		status: HealthStatus{State: HealthUnknown, Since: time.Now()},
+		stop:   make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) run() {
+	for {
+		h.record(h.check())
+
+		wait := h.policy.interval()
+		if h.isDown() && wait > healthRecoveryInterval {
+			wait = healthRecoveryInterval
+		}
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (h *healthChecker) Stop() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() { close(h.stop) })
+}
+
+// check the upstream once, via HTTP if a path is set or else a TCP connect
+func (h *healthChecker) check() error {
+	if h.policy.HealthPath == "" {
+		conn, err := net.DialTimeout("tcp", h.addr, h.client.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest("GET", "http://"+h.addr+h.policy.HealthPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = h.host
+	req.Header.Set("User-Agent", "vproxy-health-check/"+Version)
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", h.policy.HealthPath, res.Status)
+	}
+	return nil
+}
+
+// record the result of a check, updating the state once a threshold is reached
+func (h *healthChecker) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.status.LastCheck = time.Now()
+	state := h.status.State
+	if err == nil {
+		h.successes++
+		h.failures = 0
+		h.status.LastError = ""
+		if h.successes >= h.policy.healthyThreshold() {
+			state = HealthUp
+		}
+	} else {
+		h.failures++
+		h.successes = 0
+		h.status.LastError = err.Error()
+		if h.failures >= h.policy.unhealthyThreshold() {
+			state = HealthDown
+		}
+	}
+	if state == h.status.State {
+		return
+	}
+
+	prev := h.status.State
+	h.status.State = state
+	h.status.Since = h.status.LastCheck
+	if state == HealthDown {
+		fmt.Printf("[*] upstream for %s is down: %s\n", h.host, h.status.LastError)
+		events.publish(Event{Type: EventUpstreamDown, Host: h.host, Upstream: h.addr, Error: h.status.LastError})
+	} else if prev != HealthUnknown {
+		fmt.Printf("[*] upstream for %s is up\n", h.host)
+		events.publish(Event{Type: EventUpstreamUp, Host: h.host, Upstream: h.addr})
+	}
+}
+
+// Status of the upstream; empty if health checks are disabled
+func (h *healthChecker) Status() HealthStatus {
+	if h == nil {
+		return HealthStatus{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+func (h *healthChecker) isDown() bool {
+	return h.Status().State == HealthDown
+}
+
+// serveUpstreamDown without waiting on the upstream, which is known to be down
+func serveUpstreamDown(w http.ResponseWriter, r *http.Request, v *Vhost) {
+	page := &ErrorPage{
+		Kind:      ErrorUpstreamDown,
+		Status:    http.StatusServiceUnavailable,
+		Message:   fmt.Sprintf("Upstream server %s is down: %s", v.upstream(), v.Health().LastError),
+		Host:      v.Host,
+		Upstream:  v.upstream(),
+		RequestID: r.Header.Get(HeaderRequestID),
+		Refresh:   upstreamDownRefresh,
+	}
+	page.Serve(w, r, v.opts().ErrorPages)
+}
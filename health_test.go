@@ -0,0 +1,90 @@
+package vproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthThresholds(t *testing.T) {
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	h := newHealthChecker("health.local", "127.0.0.1:1", HealthPolicy{HealthyThreshold: 2})
+	assert.Equal(t, HealthUnknown, h.Status().State)
+
+	h.record(fmt.Errorf("connection refused"))
+	assert.Equal(t, HealthUnknown, h.Status().State)
+	h.record(fmt.Errorf("connection refused"))
+	assert.Equal(t, HealthDown, h.Status().State)
+	assert.Equal(t, "down: connection refused", h.Status().String())
+	e := <-ch
+	assert.Equal(t, EventUpstreamDown, e.Type)
+	assert.Equal(t, "health.local", e.Host)
+
+	h.record(nil)
+	assert.Equal(t, HealthDown, h.Status().State)
+	h.record(nil)
+	assert.Equal(t, HealthUp, h.Status().State)
+	assert.Equal(t, "", h.Status().LastError)
+	assert.Equal(t, EventUpstreamUp, (<-ch).Type)
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	healthy := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		assert.Equal(t, "app.local", r.Host)
+		if !healthy {
+			w.WriteHeader(500)
+		}
+	}))
+	defer upstream.Close()
+
+	h := newHealthChecker("app.local", strings.TrimPrefix(upstream.URL, "http://"), HealthPolicy{HealthPath: "/healthz"})
+	assert.Nil(t, h.check())
+	healthy = false
+	assert.NotNil(t, h.check())
+
+	// TCP connect
+	h = newHealthChecker("app.local", strings.TrimPrefix(upstream.URL, "http://"), HealthPolicy{})
+	assert.Nil(t, h.check())
+}
+
+func TestUpstreamDown(t *testing.T) {
+	reset()
+	// off by default
+	vhost, err := CreateVhost("down.local:1", false)
+	assert.Nil(t, err)
+	vhost.Close()
+	assert.Nil(t, vhost.health)
+
+	on := true
+	vhost, err = CreateVhostWithOptions("down.local:1", false, VhostOptions{HealthPolicy: HealthPolicy{HealthCheck: &on}})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	mux := &VhostMux{Servers: map[string]*Vhost{"down.local": vhost}}
+
+	for i := 0; i < defaultUnhealthyThreshold; i++ {
+		vhost.health.record(fmt.Errorf("connection refused"))
+	}
+
+	// served immediately, without waiting on retries
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, httptest.NewRequest("GET", "http://down.local/", nil))
+	assert.Equal(t, 503, r.Code)
+	assert.Equal(t, "2", r.Header().Get("Retry-After"))
+	assert.Equal(t, ErrorUpstreamDown, r.Header().Get(HeaderError))
+
+	buf := &bytes.Buffer{}
+	mux.DumpServers(buf)
+	assert.Contains(t, buf.String(), "down.local -> 127.0.0.1:1 (down: connection refused)")
+
+	assert.NotNil(t, HealthPolicy{HealthPath: "healthz"}.Validate())
+	assert.NotNil(t, HealthPolicy{HealthInterval: "0s"}.Validate())
+}
@@ -0,0 +1,370 @@
+package vproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults for inspector capture. Without capture enabled, a smaller number of
+// requests (without response bodies) are still retained for replay.
+var (
+	defaultCaptureSize      = 100     // exchanges per vhost
+	defaultCaptureBodyLimit = 1 << 20 // bytes per body
+	defaultRetainSize       = 20
+	defaultRetainBodyLimit  = 64 << 10
+)
+
+// Credential headers, whose values are never retained since exchanges can be
+// read by any local process via the daemon's API
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+const redactedValue = "[redacted]"
+
+// redactHeaders replaces the values of credential headers in h
+func redactHeaders(h http.Header) http.Header {
+	for _, name := range redactedHeaders {
+		vals := h.Values(name)
+		for i := range vals {
+			vals[i] = redactedValue
+		}
+	}
+	return h
+}
+
+// Exchange is a captured request/response pair
+type Exchange struct {
+	ID        string            `json:"id"`
+	RequestID string            `json:"request_id,omitempty"`
+	Time      time.Time         `json:"time"`
+	Duration  time.Duration     `json:"duration_ns"`
+	Request   *CapturedRequest  `json:"request"`
+	Response  *CapturedResponse `json:"response,omitempty"`
+	Timings   *ExchangeTimings  `json:"timings,omitempty"`   // upstream timings, if proxied
+	ReplayOf  string            `json:"replay_of,omitempty"` // ID of the original exchange
+}
+
+// CapturedRequest holds the request headers and (size-capped) body
+type CapturedRequest struct {
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	Proto      string      `json:"proto"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr"`
+	TLS        string      `json:"tls,omitempty"` // TLS version, if any
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	BodySize   int64       `json:"body_size"`
+	Truncated  bool        `json:"truncated,omitempty"`
+}
+
+// CapturedResponse holds the response headers and (size-capped) body
+type CapturedResponse struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	BodySize  int64       `json:"body_size"`
+	Truncated bool        `json:"truncated,omitempty"`
+	Captured  bool        `json:"captured"` // false if the body was not kept
+}
+
+// exchangeStore is a bounded, in-memory store of the most recent exchanges
+type exchangeStore struct {
+	mu        sync.Mutex
+	size      int
+	seq       int
+	exchanges []*Exchange
+}
+
+func newExchangeStore(size int) *exchangeStore {
+	return &exchangeStore{size: size}
+}
+
+// Add the exchange to the store, assigning it an ID
+func (s *exchangeStore) Add(ex *Exchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	ex.ID = strconv.Itoa(s.seq)
+	s.exchanges = append(s.exchanges, ex)
+	if len(s.exchanges) > s.size {
+		s.exchanges = s.exchanges[len(s.exchanges)-s.size:]
+	}
+}
+
+// List all exchanges, oldest first
+func (s *exchangeStore) List() []*Exchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Exchange{}, s.exchanges...)
+}
+
+// Get the exchange with the given ID or request ID
+func (s *exchangeStore) Get(id string) *Exchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ex := range s.exchanges {
+		if ex.ID == id || (ex.RequestID != "" && ex.RequestID == id) {
+			return ex
+		}
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first max bytes written to it, counting the rest
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+	n   int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	return bytes.Clone(b.buf.Bytes())
+}
+
+func (b *limitedBuffer) Truncated() bool {
+	return b.n > int64(b.buf.Len())
+}
+
+// teeBody copies everything read from the request body into a buffer
+type teeBody struct {
+	io.ReadCloser
+	buf *limitedBuffer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.buf.Write(p[:n])
+	return n, err
+}
+
+// exchangeCapture records a single exchange as it is served
+type exchangeCapture struct {
+	req     *http.Request
+	header  http.Header
+	reqBody *limitedBuffer
+	resBody *limitedBuffer // nil when response bodies are not captured
+	trace   *upstreamTrace
+}
+
+// newCapture starts capturing the given request. The request body is
+// replaced with one which copies into the capture buffer as it is read.
+func newCapture(r *http.Request, limit int, captureResponse bool) *exchangeCapture {
+	c := &exchangeCapture{
+		req:     r,
+		header:  redactHeaders(r.Header.Clone()),
+		reqBody: &limitedBuffer{max: limit},
+		trace:   &upstreamTrace{},
+	}
+	if captureResponse {
+		c.resBody = &limitedBuffer{max: limit}
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &teeBody{ReadCloser: r.Body, buf: c.reqBody}
+	}
+	return c
+}
+
+// exchange builds the final exchange once the request has been served
+func (c *exchangeCapture) exchange(record *LogRecord, entry *LogEntry) *Exchange {
+	r := c.req
+	res := &CapturedResponse{
+		Status:   record.status,
+		Header:   redactHeaders(record.Header().Clone()),
+		BodySize: record.responseBytes,
+	}
+	if c.resBody != nil {
+		res.Body = c.resBody.Bytes()
+		res.Truncated = c.resBody.Truncated()
+		res.Captured = true
+	}
+
+	return &Exchange{
+		RequestID: entry.RequestID,
+		Time:      entry.Time,
+		Duration:  entry.Duration,
+		Request: &CapturedRequest{
+			Method:     r.Method,
+			URI:        r.URL.RequestURI(),
+			Proto:      r.Proto,
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			TLS:        tlsVersionName(r),
+			Header:     c.header,
+			Body:       c.reqBody.Bytes(),
+			BodySize:   c.reqBody.n,
+			Truncated:  c.reqBody.Truncated(),
+		},
+		Response: res,
+		Timings:  c.trace.timings(entry.Time.Add(-entry.Duration), entry.Time),
+	}
+}
+
+// inspectList handler lists captured exchanges for a vhost
+func (d *Daemon) inspectList(w http.ResponseWriter, r *http.Request) {
+	vhost, ok := d.inspectVhost(w, r)
+	if !ok {
+		return
+	}
+
+	exchanges := vhost.exchanges.List()
+	if r.FormValue("format") == LogFormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(exchanges)
+		return
+	}
+
+	if len(exchanges) == 0 {
+		fmt.Fprintln(w, "no requests captured yet")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tMETHOD\tURI\tSTATUS\tDURATION\tREQ\tRESP\tNOTE")
+	for _, ex := range exchanges {
+		status := "-"
+		var resSize int64
+		if ex.Response != nil {
+			status = strconv.Itoa(ex.Response.Status)
+			resSize = ex.Response.BodySize
+		}
+		note := ""
+		if ex.ReplayOf != "" {
+			note = "replay of #" + ex.ReplayOf
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", ex.ID, ex.Time.Format("15:04:05"),
+			ex.Request.Method, ex.Request.URI, status, ex.Duration.Round(time.Microsecond), ex.Request.BodySize, resSize, note)
+	}
+	tw.Flush()
+}
+
+// inspectShow handler prints a single captured exchange
+func (d *Daemon) inspectShow(w http.ResponseWriter, r *http.Request) {
+	vhost, ok := d.inspectVhost(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.FormValue("id")
+	ex := vhost.exchanges.Get(id)
+	if ex == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: request '%s' not found\n", id)
+		return
+	}
+
+	if r.FormValue("format") == LogFormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ex)
+		return
+	}
+	writeExchange(w, ex)
+}
+
+// inspectVhost looks up the vhost for an inspect request
+func (d *Daemon) inspectVhost(w http.ResponseWriter, r *http.Request) (*Vhost, bool) {
+	hostname := r.FormValue("host")
+	vhost := d.loggedHandler.GetVhost(hostname)
+	if vhost == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: host '%s' not found\n", hostname)
+		return nil, false
+	}
+	return vhost, true
+}
+
+// writeExchange in a curl-like format
+func writeExchange(w io.Writer, ex *Exchange) {
+	req := ex.Request
+	fmt.Fprintf(w, "#%s %s (%s)", ex.ID, ex.Time.Format("2006-01-02 15:04:05"), ex.Duration.Round(time.Microsecond))
+	if ex.RequestID != "" {
+		fmt.Fprintf(w, " request-id=%s", ex.RequestID)
+	}
+	if ex.ReplayOf != "" {
+		fmt.Fprintf(w, " replay-of=#%s", ex.ReplayOf)
+	}
+	fmt.Fprintf(w, "\n\n> %s %s %s\n> Host: %s\n", req.Method, req.URI, req.Proto, req.Host)
+	writeHeaders(w, "> ", req.Header)
+	writeBody(w, req.Header, req.Body, req.BodySize, req.Truncated)
+
+	if res := ex.Response; res != nil {
+		fmt.Fprintf(w, "\n< %d %s\n", res.Status, http.StatusText(res.Status))
+		writeHeaders(w, "< ", res.Header)
+		if res.Captured {
+			writeBody(w, res.Header, res.Body, res.BodySize, res.Truncated)
+		} else if res.BodySize > 0 {
+			fmt.Fprintf(w, "[%d bytes, not captured (connect with --capture)]\n", res.BodySize)
+		}
+	}
+}
+
+func writeHeaders(w io.Writer, prefix string, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, k, v)
+		}
+	}
+	fmt.Fprintln(w, strings.TrimSpace(prefix))
+}
+
+func writeBody(w io.Writer, h http.Header, body []byte, size int64, truncated bool) {
+	if size == 0 {
+		return
+	}
+	if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		fmt.Fprintf(w, "[%d bytes, %s encoded]\n", size, enc)
+		return
+	}
+	if !isTextBody(h.Get("Content-Type"), body) {
+		fmt.Fprintf(w, "[%d bytes of binary data]\n", size)
+		return
+	}
+	w.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		fmt.Fprintln(w)
+	}
+	if truncated {
+		fmt.Fprintf(w, "[truncated, %d bytes total]\n", size)
+	}
+}
+
+// isTextBody guesses whether the body is printable
+func isTextBody(contentType string, body []byte) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "json"),
+		strings.HasSuffix(mt, "xml"),
+		mt == "application/x-www-form-urlencoded",
+		mt == "application/javascript":
+		return true
+	case mt == "":
+		return utf8.Valid(body)
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package vproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureAndInspect(t *testing.T) {
+	reset()
+	upstream, port := startUpstream("Content-Type")
+	defer upstream.Close()
+
+	on := true
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+	vhost, err := CreateVhostWithOptions(fmt.Sprintf("hook.local:%d", port), false,
+		VhostOptions{Capture: &on, CaptureSize: 2, CaptureBodyLimit: 8})
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "http://hook.local/webhook?n="+fmt.Sprint(i), strings.NewReader(`{"event":"push"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Add("Cookie", "session=secret")
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	exchanges := vhost.exchanges.List()
+	assert.Equal(t, 2, len(exchanges))
+	ex := exchanges[1]
+	assert.Equal(t, "3", ex.ID)
+	assert.Equal(t, "/webhook?n=2", ex.Request.URI)
+	assert.Equal(t, `{"event"`, string(ex.Request.Body))
+	assert.Equal(t, int64(16), ex.Request.BodySize)
+	assert.True(t, ex.Request.Truncated)
+	assert.Equal(t, 200, ex.Response.Status)
+	assert.Equal(t, "applicat", string(ex.Response.Body))
+	assert.Equal(t, "[redacted]", ex.Request.Header.Get("Authorization"))
+	assert.Equal(t, "[redacted]", ex.Request.Header.Get("Cookie"))
+	assert.Equal(t, "application/json", ex.Request.Header.Get("Content-Type"))
+	assert.Equal(t, []string{"[redacted]", "[redacted]"}, redactHeaders(http.Header{"Set-Cookie": {"a=1", "b=2"}})["Set-Cookie"])
+
+	form := url.Values{"host": {"hook.local"}}
+	r := httptest.NewRecorder()
+	d.inspectList(r, httptest.NewRequest("POST", "/_vproxy/inspect?"+form.Encode(), nil))
+	assert.Contains(t, r.Body.String(), "/webhook?n=1")
+	assert.NotContains(t, r.Body.String(), "/webhook?n=0")
+
+	form.Set("id", "3")
+	r = httptest.NewRecorder()
+	d.inspectShow(r, httptest.NewRequest("POST", "/_vproxy/inspect/show?"+form.Encode(), nil))
+	assert.Contains(t, r.Body.String(), "> POST /webhook?n=2 HTTP/1.1")
+	assert.Contains(t, r.Body.String(), "< 200 OK")
+
+	form.Set("id", "1")
+	r = httptest.NewRecorder()
+	d.inspectShow(r, httptest.NewRequest("POST", "/_vproxy/inspect/show?"+form.Encode(), nil))
+	assert.Equal(t, http.StatusNotFound, r.Code)
+}
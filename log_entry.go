@@ -0,0 +1,165 @@
+package vproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported access log formats
+const (
+	LogFormatText     = "text"
+	LogFormatCombined = "combined"
+	LogFormatLogfmt   = "logfmt"
+	LogFormatJSON     = "json"
+)
+
+var LogFormats = []string{LogFormatText, LogFormatCombined, LogFormatLogfmt, LogFormatJSON}
+
+// ValidateLogFormat returns an error if the format is not supported. An empty
+// format is treated as text.
+func ValidateLogFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, f := range LogFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log format '%s' (expected one of %s)", format, strings.Join(LogFormats, ", "))
+}
+
+// LogEntry is a single access log record for a vhost
+type LogEntry struct {
+	Time       time.Time     `json:"time"`
+	Vhost      string        `json:"vhost"`
+	Method     string        `json:"method,omitempty"`
+	Path       string        `json:"path,omitempty"`
+	Query      string        `json:"query,omitempty"`
+	Proto      string        `json:"proto,omitempty"`
+	TLS        string        `json:"tls,omitempty"`
+	Status     int           `json:"status,omitempty"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	Duration   time.Duration `json:"duration_ns"`
+	Upstream   string        `json:"upstream,omitempty"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	RequestID  string        `json:"request_id,omitempty"`
+	TraceID    string        `json:"trace_id,omitempty"`
+
+	// Message is set for entries which don't represent an HTTP request
+	Message string `json:"message,omitempty"`
+}
+
+// URI of the request (path and query)
+func (e *LogEntry) URI() string {
+	if e.Query == "" {
+		return e.Path
+	}
+	return e.Path + "?" + e.Query
+}
+
+// Format the entry using the given log format
+func (e *LogEntry) Format(format string) string {
+	switch format {
+	case LogFormatCombined:
+		return e.combined()
+	case LogFormatLogfmt:
+		return e.logfmt()
+	case LogFormatJSON:
+		b, _ := json.Marshal(e)
+		return string(b)
+	}
+	return e.text()
+}
+
+// text is the classic vproxy log line
+func (e *LogEntry) text() string {
+	ts := e.Time.Format("2006-01-02 15:04:05")
+	if e.Message != "" {
+		return fmt.Sprintf("%s %s [%s] %s", ts, e.RemoteAddr, e.Vhost, e.Message)
+	}
+	l := fmt.Sprintf("%s %s [%s] %s [ %d ] %s %d %s %s",
+		ts, e.RemoteAddr, e.Vhost, e.Method, e.Status, e.URI(), e.BytesIn, e.Duration, e.Proto)
+	if e.TLS != "" {
+		l += " " + e.TLS
+	}
+	return l
+}
+
+// combined is the Apache combined log format
+func (e *LogEntry) combined() string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	ts := e.Time.Format("02/Jan/2006:15:04:05 -0700")
+	if e.Message != "" {
+		return fmt.Sprintf("%s - - [%s] %q", dash(host), ts, e.Message)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"",
+		dash(host), ts, e.Method, e.URI(), e.Proto, e.Status, e.BytesOut, dash(e.Referer), dash(e.UserAgent))
+}
+
+func (e *LogEntry) logfmt() string {
+	var b strings.Builder
+	kv := func(k string, v string) {
+		if v == "" {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		if strings.ContainsAny(v, " \"=\t") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+
+	kv("time", e.Time.Format(time.RFC3339Nano))
+	kv("vhost", e.Vhost)
+	kv("msg", e.Message)
+	kv("method", e.Method)
+	kv("path", e.Path)
+	kv("query", e.Query)
+	if e.Status > 0 {
+		kv("status", strconv.Itoa(e.Status))
+	}
+	kv("bytes_in", strconv.FormatInt(e.BytesIn, 10))
+	kv("bytes_out", strconv.FormatInt(e.BytesOut, 10))
+	kv("duration", e.Duration.String())
+	kv("upstream", e.Upstream)
+	kv("remote_addr", e.RemoteAddr)
+	kv("proto", e.Proto)
+	kv("tls", e.TLS)
+	kv("request_id", e.RequestID)
+	kv("trace_id", e.TraceID)
+	return b.String()
+}
+
+// countingReader wraps a request body and counts the bytes read
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
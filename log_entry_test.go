@@ -0,0 +1,33 @@
+package vproxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogEntryFormat(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := &LogEntry{
+		Time: ts, Vhost: "app.local", Method: "GET", Path: "/foo", Query: "a=1",
+		Proto: "HTTP/1.1", Status: 200, BytesIn: 0, BytesOut: 42, Duration: 1500 * time.Microsecond,
+		RemoteAddr: "127.0.0.1:5000", UserAgent: "curl/8.0",
+	}
+
+	assert.Equal(t, "2024-01-02 03:04:05 127.0.0.1:5000 [app.local] GET [ 200 ] /foo?a=1 0 1.5ms HTTP/1.1",
+		e.Format(LogFormatText))
+	assert.Equal(t, `127.0.0.1 - - [02/Jan/2024:03:04:05 +0000] "GET /foo?a=1 HTTP/1.1" 200 42 "-" "curl/8.0"`,
+		e.Format(LogFormatCombined))
+	assert.Equal(t, "time=2024-01-02T03:04:05Z vhost=app.local method=GET path=/foo query=\"a=1\" status=200 "+
+		"bytes_in=0 bytes_out=42 duration=1.5ms remote_addr=127.0.0.1:5000 proto=HTTP/1.1",
+		e.Format(LogFormatLogfmt))
+
+	var decoded LogEntry
+	assert.Nil(t, json.Unmarshal([]byte(e.Format(LogFormatJSON)), &decoded))
+	assert.Equal(t, *e, decoded)
+
+	assert.Nil(t, ValidateLogFormat(""))
+	assert.NotNil(t, ValidateLogFormat("xml"))
+}
@@ -0,0 +1,163 @@
+package vproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Defaults for on-disk access logs
+const (
+	defaultLogMaxSize  = 10 // MB
+	defaultLogMaxFiles = 5
+)
+
+// LogPath returns the directory containing on-disk access logs
+func LogPath() string {
+	return filepath.Join(CertPath(), "logs")
+}
+
+// logFile is a size-rotated access log for a single vhost, stored as JSON
+// lines so that entries can be read back for `tail --since`
+type logFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newLogFile(host string, maxSizeMB int, maxFiles int) *logFile {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultLogMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultLogMaxFiles
+	}
+	return &logFile{
+		path:     filepath.Join(LogPath(), host+".log"),
+		maxSize:  int64(maxSizeMB) << 20,
+		maxFiles: maxFiles,
+	}
+}
+
+// Write the entry, rotating the file first if it is full
+func (l *logFile) Write(entry *LogEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+func (l *logFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts host.log -> host.log.1 -> host.log.2 ..., dropping the oldest
+func (l *logFile) rotate() error {
+	l.f.Close()
+	l.f = nil
+	os.Remove(l.rotated(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// rotated returns the path of the nth rotated file (0 is the current file)
+func (l *logFile) rotated(n int) string {
+	if n == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// Since returns all entries logged at or after the given time, oldest first.
+// Files are opened under the lock, so that a concurrent rotation can't move
+// them, but read without holding it.
+func (l *logFile) Since(since time.Time) ([]*LogEntry, error) {
+	l.mu.Lock()
+	files := []*os.File{}
+	for i := l.maxFiles; i >= 0; i-- {
+		f, err := os.Open(l.rotated(i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			l.mu.Unlock()
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	l.mu.Unlock()
+
+	entries := []*LogEntry{}
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			entry := &LogEntry{}
+			if err := json.Unmarshal(line, entry); err != nil {
+				continue // skip partial or corrupt lines
+			}
+			if !entry.Time.Before(since) {
+				entries = append(entries, entry)
+			}
+		}
+		f.Close()
+	}
+	return entries, nil
+}
+
+func (l *logFile) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
@@ -0,0 +1,85 @@
+package vproxy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	os.Setenv("CERT_PATH", t.TempDir())
+	defer os.Setenv("CERT_PATH", temp)
+
+	l := newLogFile("rotate.local", 1, 2)
+	l.maxSize = 1024 // rotate quickly
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 50; i++ {
+		err := l.Write(&LogEntry{Time: start.Add(time.Duration(i) * time.Minute), Vhost: "rotate.local", Path: fmt.Sprintf("/%d", i)})
+		assert.Nil(t, err)
+	}
+	l.Close()
+
+	_, err := os.Stat(l.rotated(2))
+	assert.Nil(t, err)
+	_, err = os.Stat(l.rotated(3))
+	assert.True(t, os.IsNotExist(err))
+
+	// oldest entries were rotated away, the rest are read back in order
+	entries, err := l.Since(start.Add(45 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(entries))
+	assert.Equal(t, "/45", entries[0].Path)
+	assert.Equal(t, "/49", entries[4].Path)
+
+	entries, _ = l.Since(time.Time{})
+	assert.True(t, len(entries) < 50)
+	assert.Equal(t, "/49", entries[len(entries)-1].Path)
+}
+
+func TestLogHistory(t *testing.T) {
+	vhost, err := CreateVhostWithOptions("history.local:8000", false, VhostOptions{LogHistory: 3})
+	assert.Nil(t, err)
+	defer vhost.Close()
+
+	for i := 0; i < 5; i++ {
+		vhost.PushLog(&LogEntry{Time: time.Now(), Path: fmt.Sprintf("/%d", i)})
+	}
+	logs := vhost.BufferedLogs()
+	assert.Equal(t, 3, len(logs))
+	assert.Equal(t, "/2", logs[0].Path)
+	assert.Equal(t, "/4", logs[2].Path)
+}
+
+func TestPushLogWhileClosing(t *testing.T) {
+	vhost, err := CreateVhostWithOptions("closing.local:8000", false, VhostOptions{LogHistory: 3})
+	assert.Nil(t, err)
+	listener := vhost.NewLogListener()
+	go func() {
+		for range listener {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				vhost.PushLog(&LogEntry{Time: time.Now(), Path: fmt.Sprintf("/%d", j)})
+				vhost.BufferedLogs()
+			}
+		}()
+	}
+	vhost.Close()
+	wg.Wait()
+
+	// pushes after close are dropped
+	vhost.PushLog(&LogEntry{Time: time.Now()})
+	assert.Equal(t, 0, len(vhost.BufferedLogs()))
+	vhost.RemoveLogListener(listener)
+	close(listener)
+}
@@ -0,0 +1,175 @@
+package vproxy
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogFilter selects which log entries are streamed to a client. Filters are
+// evaluated by the daemon so unmatched entries are never sent. Empty fields
+// match everything.
+type LogFilter struct {
+	Status      []string      // status codes or classes, e.g. "5xx", "404"
+	Methods     []string      // e.g. GET, POST
+	Path        string        // glob (e.g. "/api/**"), or a regex if prefixed with ~ ("~^/api/v[12]/")
+	MinDuration time.Duration // only requests which took at least this long
+	ExcludeExt  []string      // path extensions to skip, e.g. "js", ".css"
+
+	pathRe *regexp.Regexp
+}
+
+// Values encodes the filter as form values for the stream endpoint
+func (f LogFilter) Values() url.Values {
+	v := url.Values{}
+	for _, s := range f.Status {
+		v.Add("status", s)
+	}
+	for _, m := range f.Methods {
+		v.Add("method", m)
+	}
+	if f.Path != "" {
+		v.Set("path", f.Path)
+	}
+	if f.MinDuration > 0 {
+		v.Set("min_duration", f.MinDuration.String())
+	}
+	for _, e := range f.ExcludeExt {
+		v.Add("exclude_ext", e)
+	}
+	return v
+}
+
+// ParseLogFilter from form values, validating each field
+func ParseLogFilter(v url.Values) (*LogFilter, error) {
+	f := &LogFilter{
+		Status:     splitValues(v["status"]),
+		Methods:    splitValues(v["method"]),
+		Path:       v.Get("path"),
+		ExcludeExt: splitValues(v["exclude_ext"]),
+	}
+	if d := v.Get("min_duration"); d != "" {
+		var err error
+		if f.MinDuration, err = time.ParseDuration(d); err != nil {
+			return nil, fmt.Errorf("invalid min duration '%s': %s", d, err)
+		}
+	}
+	return f, f.Validate()
+}
+
+// splitValues flattens repeated and comma-separated values
+func splitValues(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+var reStatus = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+
+// Validate the filter and compile the path pattern
+func (f *LogFilter) Validate() error {
+	for _, s := range f.Status {
+		if !reStatus.MatchString(strings.ToLower(s)) {
+			return fmt.Errorf("invalid status filter '%s' (expected e.g. 5xx or 404)", s)
+		}
+	}
+	if f.Path == "" {
+		return nil
+	}
+	expr := globToRegexp(f.Path)
+	if strings.HasPrefix(f.Path, "~") {
+		expr = f.Path[1:]
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid path filter '%s': %s", f.Path, err)
+	}
+	f.pathRe = re
+	return nil
+}
+
+// globToRegexp converts a path glob to an anchored regex: `*` matches within a
+// path segment, `**` across segments and `?` a single character
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// IsEmpty returns true if the filter matches everything
+func (f *LogFilter) IsEmpty() bool {
+	return f == nil || (len(f.Status) == 0 && len(f.Methods) == 0 && f.Path == "" &&
+		f.MinDuration == 0 && len(f.ExcludeExt) == 0)
+}
+
+// Match returns true if the entry passes the filter. Entries which don't
+// represent a request (messages) always match.
+func (f *LogFilter) Match(e *LogEntry) bool {
+	if f.IsEmpty() || e.Message != "" {
+		return true
+	}
+
+	if len(f.Status) > 0 && !f.matchStatus(e.Status) {
+		return false
+	}
+	if len(f.Methods) > 0 && !matchAny(f.Methods, func(m string) bool { return strings.EqualFold(m, e.Method) }) {
+		return false
+	}
+	if f.MinDuration > 0 && e.Duration < f.MinDuration {
+		return false
+	}
+	if len(f.ExcludeExt) > 0 {
+		ext := strings.TrimPrefix(path.Ext(e.Path), ".")
+		if ext != "" && matchAny(f.ExcludeExt, func(x string) bool { return strings.EqualFold(strings.TrimPrefix(x, "."), ext) }) {
+			return false
+		}
+	}
+	if f.pathRe != nil {
+		return f.pathRe.MatchString(e.Path)
+	}
+	return true
+}
+
+func (f *LogFilter) matchStatus(status int) bool {
+	code := strconv.Itoa(status)
+	return matchAny(f.Status, func(s string) bool {
+		s = strings.ToLower(s)
+		if strings.HasSuffix(s, "xx") {
+			return len(code) == 3 && code[0] == s[0]
+		}
+		return s == code
+	})
+}
+
+func matchAny(list []string, fn func(string) bool) bool {
+	for _, s := range list {
+		if fn(s) {
+			return true
+		}
+	}
+	return false
+}
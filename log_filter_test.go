@@ -0,0 +1,51 @@
+package vproxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFilter(t *testing.T) {
+	filter := LogFilter{
+		Status:      []string{"5xx", "404"},
+		Methods:     []string{"get", "POST"},
+		Path:        "/api/**",
+		MinDuration: 10 * time.Millisecond,
+		ExcludeExt:  []string{".js"},
+	}
+	// round trip through form values, as sent to the daemon
+	f, err := ParseLogFilter(filter.Values())
+	assert.Nil(t, err)
+
+	entry := func(method string, path string, status int, dur time.Duration) *LogEntry {
+		return &LogEntry{Method: method, Path: path, Status: status, Duration: dur}
+	}
+	assert.True(t, f.Match(entry("GET", "/api/v1/users", 503, time.Second)))
+	assert.True(t, f.Match(entry("POST", "/api/x", 404, time.Second)))
+	assert.False(t, f.Match(entry("GET", "/api/v1/users", 200, time.Second)))
+	assert.False(t, f.Match(entry("DELETE", "/api/v1/users", 500, time.Second)))
+	assert.False(t, f.Match(entry("GET", "/app/v1/users", 500, time.Second)))
+	assert.False(t, f.Match(entry("GET", "/api/v1/users", 500, time.Millisecond)))
+	assert.False(t, f.Match(entry("GET", "/api/app.js", 500, time.Second)))
+	assert.True(t, f.Match(&LogEntry{Message: "upstream down"}))
+
+	f, err = ParseLogFilter(url.Values{"path": {"~^/v[12]/"}})
+	assert.Nil(t, err)
+	assert.True(t, f.Match(entry("GET", "/v2/x", 200, 0)))
+	assert.False(t, f.Match(entry("GET", "/v3/x", 200, 0)))
+
+	f, err = ParseLogFilter(url.Values{"path": {"/static/*.css"}})
+	assert.Nil(t, err)
+	assert.True(t, f.Match(entry("GET", "/static/app.css", 200, 0)))
+	assert.False(t, f.Match(entry("GET", "/static/css/app.css", 200, 0)))
+
+	_, err = ParseLogFilter(url.Values{"status": {"6xx"}})
+	assert.NotNil(t, err)
+	_, err = ParseLogFilter(url.Values{"path": {"~("}})
+	assert.NotNil(t, err)
+	_, err = ParseLogFilter(url.Values{"min_duration": {"soon"}})
+	assert.NotNil(t, err)
+}
@@ -3,11 +3,13 @@ package vproxy
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
@@ -24,8 +26,17 @@ type LoggedHandler struct {
 	defaultHost string
 	defaultCert string
 	defaultKey  string
+
+	httpsPort int // for redirecting to HTTPS; 0 if disabled
+	logFormat string
+	spans     *spanExporter // optional OTLP span export
+	dashboard http.Handler  // served on defaultHost
+	acme      *acmeServer   // optional; its pending challenges skip the HTTPS redirect
 }
 
+// Default HSTS max-age; kept short since dev hostnames come and go
+var defaultHSTSMaxAge = 3600
+
 // NewLoggedHandler wraps the given handler with a request/response logger
 func NewLoggedHandler(vm *VhostMux) *LoggedHandler {
 	lh := &LoggedHandler{
@@ -73,6 +84,9 @@ func (lh *LoggedHandler) DumpServers(w io.Writer) {
 // Create multi-certificate TLS config from vhost config
 func (lh *LoggedHandler) CreateTLSConfig() *tls.Config {
 	cfg := &tls.Config{}
+	if err := DefaultVhostOptions.TLSPolicy.apply(cfg); err != nil {
+		log.Fatal("invalid TLS policy: ", err)
+	}
 
 	// Add default internal cert
 	cert, err := tls.LoadX509KeyPair(lh.defaultCert, lh.defaultKey)
@@ -90,35 +104,243 @@ func (lh *LoggedHandler) CreateTLSConfig() *tls.Config {
 		cfg.Certificates = append(cfg.Certificates, cert)
 	}
 
+	// each vhost gets its own config (TLS policy, client auth), selected by SNI.
+	// always return one so that ALPN is not overridden by http.Server.
+	defaultConfig := cfg.Clone()
+	vhostConfigs := map[string]*tls.Config{}
+	for _, server := range lh.vhostMux.Servers {
+		vcfg, err := vhostTLSConfig(cfg, lh.tlsOpts(server))
+		if err != nil {
+			fmt.Printf("[*] warning: failed to configure TLS for %s: %s\n", server.Host, err)
+			continue
+		}
+		vhostConfigs[server.Host] = vcfg
+	}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if vcfg := vhostConfigs[hello.ServerName]; vcfg != nil {
+			return vcfg, nil
+		}
+		return defaultConfig, nil
+	}
+
 	// build cn and return
 	// cfg.BuildNameToCertificate()
 	return cfg
 }
 
+// tlsOpts returns the vhost's options, with the TLS policy and client auth of
+// the target for an alias, which is served by the target
+func (lh *LoggedHandler) tlsOpts(vhost *Vhost) VhostOptions {
+	opts := vhost.opts()
+	if target := lh.GetVhost(vhost.Options.AliasOf); target != nil {
+		t := target.opts()
+		opts.TLSPolicy, opts.ClientAuth, opts.ClientCA = t.TLSPolicy, t.ClientAuth, t.ClientCA
+	}
+	return opts
+}
+
+// vhostTLSConfig derives a TLS config for a vhost with the given options from
+// the base config
+func vhostTLSConfig(base *tls.Config, opts VhostOptions) (*tls.Config, error) {
+	cfg := base.Clone()
+	if err := opts.TLSPolicy.apply(cfg); err != nil {
+		return nil, err
+	}
+
+	switch opts.ClientAuth {
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		pool, err := clientCAPool(opts.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// clientCAPool loads the given PEM file, or the local CA if empty
+func clientCAPool(file string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if file == "" {
+		ca, err := loadCACert()
+		if err != nil {
+			return nil, err
+		}
+		pool.AddCert(ca)
+		return pool, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certs found in client CA file %s", file)
+	}
+	return pool, nil
+}
+
 func (lh *LoggedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	record := &LogRecord{
 		ResponseWriter: w,
 	}
 
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	host := getHostName(r.Host)
+	entry := &LogEntry{
+		Vhost:      host,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Proto:      r.Proto,
+		TLS:        tlsVersionName(r),
+		RemoteAddr: r.RemoteAddr,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	var capture *exchangeCapture
+	var trace *traceContext
+	replay, _ := r.Context().Value(replayKey{}).(*replayState)
+	vhost := lh.GetVhost(host)
+	if vhost != nil {
+		entry.Upstream = vhost.upstream()
+		if !isControlPath(r.URL.Path) {
+			entry.RequestID, trace = startTrace(r, lh.spans != nil)
+			entry.TraceID = trace.TraceID
+			capture = newCapture(r, vhost.captureBodyLimit(), isTrue(vhost.opts().Capture) || replay != nil)
+			record.body = capture.resBody
+			r = r.WithContext(withUpstreamTrace(r.Context(), capture.trace))
+		}
+	}
+
 	// serve request and capture timings
 	startTime := time.Now()
-	lh.ServeMux.ServeHTTP(record, r)
+	lh.serve(record, r)
 	finishTime := time.Now()
-	elapsedTime := finishTime.Sub(startTime)
-	host := getHostName(r.Host)
 
-	l := fmt.Sprintf("%s %s [%s] %s [ %d ] %s %d %s",
-		time.Now().Format("2006-01-02 15:04:05"),
-		r.RemoteAddr, host, r.Method, record.status, r.URL, r.ContentLength, elapsedTime)
+	entry.Time = finishTime
+	entry.Duration = finishTime.Sub(startTime)
+	entry.Status = record.status
+	entry.BytesOut = record.responseBytes
+	if body != nil {
+		entry.BytesIn = body.n
+	}
+	if capture != nil {
+		ex := capture.exchange(record, entry)
+		if replay != nil {
+			ex.ReplayOf = replay.of
+			replay.result = ex
+		}
+		vhost.exchanges.Add(ex)
+		if file := vhost.opts().HARFile; file != "" {
+			appendHAR(file, ex)
+		}
+	}
+
+	if vhost != nil && !isControlPath(r.URL.Path) {
+		metrics.observe(entry)
+	}
+	if lh.spans != nil && trace != nil {
+		lh.spans.Export(newSpan(trace, entry))
+	}
+	lh.pushLog(host, entry)
+}
 
-	lh.pushLog(host, l)
+// SetLogFormat for access logs printed by the daemon
+func (lh *LoggedHandler) SetLogFormat(format string) error {
+	if err := ValidateLogFormat(format); err != nil {
+		return err
+	}
+	lh.logFormat = format
+	return nil
 }
 
-func (lh *LoggedHandler) pushLog(host string, msg string) {
-	fmt.Println(msg)
+// serve the request, applying any per-vhost HTTPS policies first
+func (lh *LoggedHandler) serve(w http.ResponseWriter, r *http.Request) {
+	vhost := lh.GetVhost(getHostName(r.Host))
+	if vhost == nil && lh.dashboard != nil && getHostName(r.Host) == lh.defaultHost && !isControlPath(r.URL.Path) {
+		lh.dashboard.ServeHTTP(w, r)
+		return
+	}
+	if vhost == nil || isControlPath(r.URL.Path) {
+		lh.ServeMux.ServeHTTP(w, r)
+		return
+	}
+
+	opts := vhost.opts()
+	if !lh.checkClientCert(w, r, vhost) {
+		return
+	}
+	if r.TLS == nil && isTrue(opts.RedirectHTTPS) && lh.httpsPort > 0 && !lh.isACMEChallenge(r) {
+		host := getHostName(r.Host)
+		if lh.httpsPort != 443 {
+			host = fmt.Sprintf("%s:%d", host, lh.httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+		return
+	}
+
+	if r.TLS != nil && isTrue(opts.HSTS) {
+		maxAge := opts.HSTSMaxAge
+		if maxAge == 0 {
+			maxAge = defaultHSTSMaxAge
+		}
+		w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", maxAge))
+	}
+
+	lh.ServeMux.ServeHTTP(w, r)
+}
+
+// checkClientCert enforces "require" client auth on each request. The TLS
+// config is selected by SNI alone and plain HTTP has no handshake at all, so a
+// request for the vhost may otherwise arrive without a verified client cert.
+// Aliases are held to their target's policy. Returns false if rejected.
+func (lh *LoggedHandler) checkClientCert(w http.ResponseWriter, r *http.Request, vhost *Vhost) bool {
+	if lh.tlsOpts(vhost).ClientAuth != "require" {
+		return true
+	}
+	switch {
+	case r.TLS == nil:
+		http.Error(w, "client certificate required (use https)", http.StatusForbidden)
+	case r.TLS.ServerName != vhost.Host:
+		http.Error(w, fmt.Sprintf("misdirected request: TLS server name '%s' does not match host %s", r.TLS.ServerName, vhost.Host), http.StatusMisdirectedRequest)
+	case len(r.TLS.VerifiedChains) == 0:
+		http.Error(w, "client certificate required", http.StatusForbidden)
+	default:
+		return true
+	}
+	return false
+}
+
+// isControlPath returns true for daemon control calls, which must stay
+// reachable over plain HTTP
+func isControlPath(path string) bool {
+	return strings.HasPrefix(path, "/_vproxy/")
+}
+
+// isACMEChallenge returns true for an HTTP-01 validation request which the
+// ACME server is currently waiting on. These must not be redirected to HTTPS.
+func (lh *LoggedHandler) isACMEChallenge(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	return ok && lh.acme != nil && lh.acme.pendingChallenge(getHostName(r.Host), token)
+}
+
+func (lh *LoggedHandler) pushLog(host string, entry *LogEntry) {
+	fmt.Println(entry.Format(lh.logFormat))
 
 	if vhost := lh.GetVhost(host); vhost != nil {
-		vhost.PushLog(msg)
+		vhost.PushLog(entry)
 	}
 }
 
@@ -134,12 +356,19 @@ type LogRecord struct {
 	http.ResponseWriter
 	status        int
 	responseBytes int64
+	body          *limitedBuffer // optional copy of the response body
 }
 
 // Write wrapper that counts bytes
 func (r *LogRecord) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
 	written, err := r.ResponseWriter.Write(p)
 	r.responseBytes += int64(written)
+	if r.body != nil {
+		r.body.Write(p[:written])
+	}
 	return written, err
 }
 
@@ -0,0 +1,204 @@
+package vproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startUpstream echoes the given request header back in the response body
+func startUpstream(header string) (*httptest.Server, int) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get(header))
+	}))
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return upstream, port
+}
+
+func TestClientCertAuth(t *testing.T) {
+	reset()
+	upstream, port := startUpstream("X-Client-Cert-Subject")
+	defer upstream.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	vhost, err := CreateVhostWithOptions(fmt.Sprintf("mtls.local:%d", port), true, VhostOptions{ClientAuth: "require"})
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+	alias, err := CreateVhostWithOptions("alias.mtls.local", true, VhostOptions{AliasOf: "mtls.local"})
+	assert.Nil(t, err)
+	lh.AddVhost(alias)
+	other, err := CreateVhostWithOptions(fmt.Sprintf("other.local:%d", port), true, VhostOptions{})
+	assert.Nil(t, err)
+	lh.AddVhost(other)
+
+	server := httptest.NewUnstartedServer(lh)
+	server.TLS = lh.CreateTLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	ca, _ := loadCACert()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: "mtls.local"}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	// without a client cert
+	_, err = client.Get(server.URL)
+	assert.NotNil(t, err)
+
+	certFile, keyFile, err := MakeClientCert("alice", temp)
+	assert.Nil(t, err)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err)
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Host = "mtls.local"
+	req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "CN=alice,O=vproxy client certificate", string(body))
+
+	// a cert verified for one vhost isn't passed on to another
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	req.Host = "other.local"
+	req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+	res, err = client.Do(req)
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "", string(body))
+
+	// aliases ask for a client cert just like their target
+	aliasConfig := tlsConfig.Clone()
+	aliasConfig.ServerName = "alias.mtls.local"
+	aliasClient := &http.Client{Transport: &http.Transport{TLSClientConfig: aliasConfig}}
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	req.Host = "alias.mtls.local"
+	res, err = aliasClient.Do(req)
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "CN=alice,O=vproxy client certificate", string(body))
+
+	// SNI for another host, or none at all, skips client auth in the handshake
+	for _, sni := range []string{"vproxy.local", ""} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName: sni, InsecureSkipVerify: true,
+		}}}
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Host = "mtls.local"
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusMisdirectedRequest, res.StatusCode, sni)
+	}
+
+	// plain HTTP, including acme challenges
+	r := httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://mtls.local/", nil))
+	assert.Equal(t, http.StatusForbidden, r.Code)
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://mtls.local/.well-known/acme-challenge/x", nil))
+	assert.Equal(t, http.StatusForbidden, r.Code)
+
+	// TLS for the right host, but without a verified cert
+	req = httptest.NewRequest("GET", "https://mtls.local/", nil)
+	req.TLS.ServerName = "mtls.local"
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, req)
+	assert.Equal(t, http.StatusForbidden, r.Code)
+}
+
+func TestVhostTLSPolicy(t *testing.T) {
+	reset()
+	h2 := false
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	vhost, err := CreateVhostWithOptions("legacy.local:8000", true, VhostOptions{
+		TLSPolicy: TLSPolicy{TLSMaxVersion: "1.2", HTTP2: &h2},
+	})
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	server := httptest.NewUnstartedServer(lh)
+	server.TLS = lh.CreateTLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	ca, _ := loadCACert()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	dial := func(host string) tls.ConnectionState {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+			RootCAs: roots, ServerName: host, NextProtos: []string{"h2", "http/1.1"},
+		})
+		assert.Nil(t, err)
+		defer conn.Close()
+		return conn.ConnectionState()
+	}
+
+	state := dial("legacy.local")
+	assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+	assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+
+	state = dial("vproxy.local")
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	assert.Equal(t, "h2", state.NegotiatedProtocol)
+
+	_, err = CreateVhostWithOptions("bad.local:8000", true, VhostOptions{TLSPolicy: TLSPolicy{TLSMinVersion: "1.4"}})
+	assert.NotNil(t, err)
+}
+
+func TestRedirectHTTPSAndHSTS(t *testing.T) {
+	reset()
+	upstream, port := startUpstream("X-Forwarded-Proto")
+	defer upstream.Close()
+
+	on := true
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	lh.httpsPort = 8443
+	vhost, err := CreateVhostWithOptions(fmt.Sprintf("secure.local:%d", port), true, VhostOptions{RedirectHTTPS: &on, HSTS: &on})
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	r := httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://secure.local/foo?x=1", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, r.Code)
+	assert.Equal(t, "https://secure.local:8443/foo?x=1", r.Header().Get("Location"))
+
+	// acme challenges are only exempt while pending for the host
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://secure.local/.well-known/acme-challenge/abc", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, r.Code)
+
+	lh.acme = newACMEServer(DefaultACMESuffixes)
+	lh.acme.authzs["1"] = &acmeAuthz{status: "pending", token: "abc", identifier: acmeIdentifier{Type: "dns", Value: "secure.local"}}
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://secure.local/.well-known/acme-challenge/abc", nil))
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "", r.Header().Get("Strict-Transport-Security"))
+
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://secure.local/.well-known/acme-challenge/other", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, r.Code)
+
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "https://secure.local/foo", nil))
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "https", r.Body.String())
+	assert.Equal(t, "max-age=3600", r.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,177 @@
+package vproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// vhostMetrics are the counters for a single vhost
+type vhostMetrics struct {
+	requests       map[string]uint64 // by status class, e.g. "2xx"
+	buckets        []uint64          // cumulative counts per latency bucket
+	durationSum    float64
+	durationCount  uint64
+	bytesIn        int64
+	bytesOut       int64
+	upstreamErrors uint64
+	retries        uint64
+}
+
+// metricsRegistry collects metrics for all vhosts, rendered in the Prometheus
+// text format
+type metricsRegistry struct {
+	mu     sync.Mutex
+	vhosts map[string]*vhostMetrics
+
+	activeConns int64
+}
+
+// metrics is shared by the handler and the proxy transports
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{vhosts: map[string]*vhostMetrics{}}
+}
+
+// get the metrics for the vhost; must be called with the lock held
+func (m *metricsRegistry) get(vhost string) *vhostMetrics {
+	vm := m.vhosts[vhost]
+	if vm == nil {
+		vm = &vhostMetrics{requests: map[string]uint64{}, buckets: make([]uint64, len(latencyBuckets))}
+		m.vhosts[vhost] = vm
+	}
+	return vm
+}
+
+// observe a completed request
+func (m *metricsRegistry) observe(e *LogEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vm := m.get(e.Vhost)
+	vm.requests[statusClass(e.Status)]++
+	secs := e.Duration.Seconds()
+	for i, b := range latencyBuckets {
+		if secs <= b {
+			vm.buckets[i]++
+		}
+	}
+	vm.durationSum += secs
+	vm.durationCount++
+	vm.bytesIn += e.BytesIn
+	vm.bytesOut += e.BytesOut
+}
+
+func (m *metricsRegistry) upstreamError(vhost string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(vhost).upstreamErrors++
+}
+
+func (m *metricsRegistry) retry(vhost string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(vhost).retries++
+}
+
+// connState tracks active client connections; used as http.Server.ConnState
+func (m *metricsRegistry) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&m.activeConns, 1)
+	case http.StateClosed, http.StateHijacked:
+		atomic.AddInt64(&m.activeConns, -1)
+	}
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// write all metrics in the Prometheus text exposition format. Log listeners
+// are counted from the currently registered vhosts.
+func (m *metricsRegistry) write(w io.Writer, vhosts []*Vhost) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.vhosts))
+	for name := range m.vhosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("vproxy_requests_total", "counter", "Requests served, by vhost and status class.")
+	for _, name := range names {
+		vm := m.vhosts[name]
+		classes := make([]string, 0, len(vm.requests))
+		for c := range vm.requests {
+			classes = append(classes, c)
+		}
+		sort.Strings(classes)
+		for _, c := range classes {
+			fmt.Fprintf(w, "vproxy_requests_total{vhost=%q,code=%q} %d\n", name, c, vm.requests[c])
+		}
+	}
+
+	header("vproxy_request_duration_seconds", "histogram", "Request latency, including the upstream.")
+	for _, name := range names {
+		vm := m.vhosts[name]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "vproxy_request_duration_seconds_bucket{vhost=%q,le=%q} %d\n", name, strconv.FormatFloat(b, 'g', -1, 64), vm.buckets[i])
+		}
+		fmt.Fprintf(w, "vproxy_request_duration_seconds_bucket{vhost=%q,le=\"+Inf\"} %d\n", name, vm.durationCount)
+		fmt.Fprintf(w, "vproxy_request_duration_seconds_sum{vhost=%q} %g\n", name, vm.durationSum)
+		fmt.Fprintf(w, "vproxy_request_duration_seconds_count{vhost=%q} %d\n", name, vm.durationCount)
+	}
+
+	header("vproxy_request_bytes_total", "counter", "Request body bytes received.")
+	for _, name := range names {
+		fmt.Fprintf(w, "vproxy_request_bytes_total{vhost=%q} %d\n", name, m.vhosts[name].bytesIn)
+	}
+	header("vproxy_response_bytes_total", "counter", "Response body bytes sent.")
+	for _, name := range names {
+		fmt.Fprintf(w, "vproxy_response_bytes_total{vhost=%q} %d\n", name, m.vhosts[name].bytesOut)
+	}
+	header("vproxy_upstream_errors_total", "counter", "Requests which failed to reach the upstream after retrying.")
+	for _, name := range names {
+		fmt.Fprintf(w, "vproxy_upstream_errors_total{vhost=%q} %d\n", name, m.vhosts[name].upstreamErrors)
+	}
+	header("vproxy_upstream_retries_total", "counter", "Upstream request retries (backoff).")
+	for _, name := range names {
+		fmt.Fprintf(w, "vproxy_upstream_retries_total{vhost=%q} %d\n", name, m.vhosts[name].retries)
+	}
+
+	header("vproxy_active_connections", "gauge", "Open client connections.")
+	fmt.Fprintf(w, "vproxy_active_connections %d\n", atomic.LoadInt64(&m.activeConns))
+
+	header("vproxy_vhosts", "gauge", "Registered vhosts.")
+	fmt.Fprintf(w, "vproxy_vhosts %d\n", len(vhosts))
+
+	header("vproxy_log_listeners", "gauge", "Clients streaming logs, by vhost.")
+	sort.Slice(vhosts, func(i, j int) bool { return vhosts[i].Host < vhosts[j].Host })
+	for _, v := range vhosts {
+		fmt.Fprintf(w, "vproxy_log_listeners{vhost=%q} %d\n", v.Host, v.listenerCount())
+	}
+}
+
+// serveMetrics handler
+func (d *Daemon) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	vhosts := d.vhosts()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w, vhosts)
+}
@@ -0,0 +1,40 @@
+package vproxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	reset()
+	upstream, port := startUpstream("X-Test")
+	defer upstream.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+	vhost, err := CreateVhost(fmt.Sprintf("metrics.local:%d", port), false)
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "http://metrics.local/", strings.NewReader("hello"))
+		req.Header.Set("X-Test", "ok")
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	vhost.NewLogListener()
+
+	r := httptest.NewRecorder()
+	d.serveMetrics(r, httptest.NewRequest("GET", "/_vproxy/metrics", nil))
+	body := r.Body.String()
+	assert.Contains(t, body, "# TYPE vproxy_request_duration_seconds histogram")
+	assert.Contains(t, body, `vproxy_requests_total{vhost="metrics.local",code="2xx"} 3`)
+	assert.Contains(t, body, `vproxy_request_duration_seconds_bucket{vhost="metrics.local",le="+Inf"} 3`)
+	assert.Contains(t, body, `vproxy_request_duration_seconds_count{vhost="metrics.local"} 3`)
+	assert.Contains(t, body, `vproxy_request_bytes_total{vhost="metrics.local"} 15`)
+	assert.Contains(t, body, `vproxy_response_bytes_total{vhost="metrics.local"} 6`)
+	assert.Contains(t, body, `vproxy_log_listeners{vhost="metrics.local"} 1`)
+}
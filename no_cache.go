@@ -0,0 +1,26 @@
+package vproxy
+
+import "net/http"
+
+// conditional request headers which let the upstream answer 304 Not Modified
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// response headers which allow the browser to cache or revalidate
+var cacheHeaders = []string{"ETag", "Last-Modified", "Expires", "Age", "Pragma"}
+
+// stripConditionalHeaders so that the upstream always sends a full response
+// (no_cache mode)
+func stripConditionalHeaders(r *http.Request) {
+	for _, name := range conditionalHeaders {
+		r.Header.Del(name)
+	}
+}
+
+// disableCaching of the response, so that the browser never serves stale
+// assets during development (no_cache mode)
+func disableCaching(res *http.Response) {
+	for _, name := range cacheHeaders {
+		res.Header.Del(name)
+	}
+	res.Header.Set("Cache-Control", "no-store")
+}
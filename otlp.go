@@ -0,0 +1,216 @@
+package vproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP/HTTP JSON types (only the fields we send)
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code int `json:"code,omitempty"` // 2 = error
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 is encoded as a string
+}
+
+func strAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+const otlpSpanKindServer = 2
+
+// newSpan for a completed request
+func newSpan(tc *traceContext, e *LogEntry) *otlpSpan {
+	start := e.Time.Add(-e.Duration)
+	span := &otlpSpan{
+		TraceID:           tc.TraceID,
+		SpanID:            tc.SpanID,
+		ParentSpanID:      tc.ParentID,
+		Name:              e.Method + " " + e.Vhost,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(e.Time.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			strAttr("http.request.method", e.Method),
+			strAttr("url.path", e.Path),
+			strAttr("server.address", e.Vhost),
+			strAttr("network.protocol.version", strings.TrimPrefix(e.Proto, "HTTP/")),
+			strAttr("client.address", e.RemoteAddr),
+			strAttr("vproxy.upstream", e.Upstream),
+			strAttr("vproxy.request_id", e.RequestID),
+			intAttr("http.response.status_code", int64(e.Status)),
+			intAttr("http.request.body.size", e.BytesIn),
+			intAttr("http.response.body.size", e.BytesOut),
+		},
+	}
+	if e.Query != "" {
+		span.Attributes = append(span.Attributes, strAttr("url.query", e.Query))
+	}
+	if e.Status >= 500 {
+		span.Status.Code = 2
+	}
+	return span
+}
+
+// spanExporter batches spans and posts them to an OTLP/HTTP collector
+type spanExporter struct {
+	endpoint string
+	client   *http.Client
+	spans    chan *otlpSpan
+
+	batchSize int
+	interval  time.Duration
+
+	closeOnce sync.Once
+	quit      chan struct{} // closed on Close; spans is never closed
+	done      chan struct{}
+}
+
+// newSpanExporter for the given collector, e.g. http://127.0.0.1:4318. The
+// /v1/traces path is added if missing.
+func newSpanExporter(endpoint string) *spanExporter {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	e := &spanExporter{
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		spans:     make(chan *otlpSpan, 1000),
+		batchSize: 100,
+		interval:  2 * time.Second,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues the span, dropping it if the queue is full or the exporter
+// was closed. Requests may still finish after Close.
+func (e *spanExporter) Export(span *otlpSpan) {
+	select {
+	case <-e.quit:
+	case e.spans <- span:
+	default:
+	}
+}
+
+// Close sends any queued spans and stops the exporter
+func (e *spanExporter) Close() {
+	e.closeOnce.Do(func() {
+		close(e.quit)
+		<-e.done
+	})
+}
+
+func (e *spanExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	batch := []*otlpSpan{}
+	for {
+		select {
+		case <-e.quit:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			e.send(batch)
+			return
+		case span := <-e.spans:
+			if batch = append(batch, span); len(batch) >= e.batchSize {
+				e.send(batch)
+				batch = []*otlpSpan{}
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = []*otlpSpan{}
+		}
+	}
+}
+
+func (e *spanExporter) send(spans []*otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	scope := otlpScopeSpans{Spans: spans}
+	scope.Scope.Name = "vproxy"
+	scope.Scope.Version = Version
+	payload := otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{strAttr("service.name", "vproxy")}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		fmt.Printf("[*] warning: failed to export spans: %s\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		fmt.Printf("[*] warning: failed to export spans to %s: %s\n", e.endpoint, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		fmt.Printf("[*] warning: failed to export spans to %s: %s\n", e.endpoint, res.Status)
+	}
+}
@@ -0,0 +1,55 @@
+package vproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanExport(t *testing.T) {
+	reset()
+	upstream, port := startUpstream(HeaderTraceparent)
+	defer upstream.Close()
+
+	spans := []*otlpSpan{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		export := otlpExport{}
+		json.NewDecoder(r.Body).Decode(&export)
+		spans = append(spans, export.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}))
+	defer collector.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	lh.spans = newSpanExporter(collector.URL)
+	vhost, err := CreateVhost(fmt.Sprintf("span.local:%d", port), false)
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	req := httptest.NewRequest("GET", "http://span.local/x", nil)
+	req.Header.Set(HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	lh.ServeHTTP(w, req)
+	lh.spans.Close()
+
+	// upstream sees the proxy span as its parent
+	tc := parseTraceparent(w.Body.String())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tc.TraceID)
+	assert.NotEqual(t, "00f067aa0ba902b7", tc.ParentID)
+
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].ParentSpanID)
+	assert.Equal(t, tc.ParentID, spans[0].SpanID)
+	assert.Equal(t, "GET span.local", spans[0].Name)
+
+	// requests finishing after shutdown are dropped
+	w = httptest.NewRecorder()
+	lh.ServeHTTP(w, httptest.NewRequest("GET", "http://span.local/y", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(spans))
+}
@@ -0,0 +1,66 @@
+package vproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Default status for redirect vhosts. Temporary, so that browsers don't cache
+// it while hostnames are still changing.
+const defaultRedirectCode = http.StatusFound
+
+// redirectHandler redirects all requests to another URL, preserving the path
+// and query
+type redirectHandler struct {
+	target *url.URL
+	code   int
+}
+
+func newRedirectHandler(target string, code int) *redirectHandler {
+	// validated along with the options
+	u, _ := url.Parse(target)
+	if code == 0 {
+		code = defaultRedirectCode
+	}
+	return &redirectHandler{target: u, code: code}
+}
+
+func (h *redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, h.location(r), h.code)
+}
+
+// location for the request: the target URL with the request path appended and
+// both queries combined
+func (h *redirectHandler) location(r *http.Request) string {
+	base := *h.target
+	base.RawQuery, base.Fragment = "", ""
+	loc := strings.TrimSuffix(base.String(), "/") + r.URL.EscapedPath()
+
+	query := h.target.RawQuery
+	if r.URL.RawQuery != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += r.URL.RawQuery
+	}
+	if query != "" {
+		loc += "?" + query
+	}
+	return loc
+}
+
+// validateRedirect URL and status code
+func validateRedirect(target string, code int) error {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid redirect URL '%s' (expected e.g. https://new.local)", target)
+	}
+	switch code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect code %d (expected 301, 302, 307 or 308)", code)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package vproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectVhost(t *testing.T) {
+	reset()
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, false))
+	vhost, err := CreateVhostWithOptions("old.local", false, VhostOptions{Redirect: "https://new.local/base/?src=old", RedirectCode: 301})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+	assert.Equal(t, "https://new.local/base/?src=old", vhost.upstream())
+
+	r := httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("POST", "http://old.local/a%20b/c?x=1", nil))
+	assert.Equal(t, http.StatusMovedPermanently, r.Code)
+	assert.Equal(t, "https://new.local/base/a%20b/c?src=old&x=1", r.Header().Get("Location"))
+
+	vhost, err = CreateVhostWithOptions("old.local", false, VhostOptions{Redirect: "https://new.local"})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://old.local/", nil))
+	assert.Equal(t, http.StatusFound, r.Code)
+	assert.Equal(t, "https://new.local/", r.Header().Get("Location"))
+
+	assert.NotNil(t, VhostOptions{Redirect: "https://new.local", RedirectCode: 303}.Validate())
+	assert.NotNil(t, VhostOptions{Redirect: "new.local"}.Validate())
+	assert.NotNil(t, VhostOptions{RedirectCode: 301}.Validate())
+	assert.NotNil(t, VhostOptions{Redirect: "https://new.local", AliasOf: "new.local"}.Validate())
+}
+
+func TestAliasVhost(t *testing.T) {
+	reset()
+	upstream, port := startUpstream("X-Forwarded-Host")
+	defer upstream.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, false))
+	target, err := CreateVhostWithOptions(fmt.Sprintf("new.local:%d", port), false, VhostOptions{})
+	assert.Nil(t, err)
+	lh.AddVhost(target)
+	alias, err := CreateVhostWithOptions("old.local", false, VhostOptions{AliasOf: "new.local"})
+	assert.Nil(t, err)
+	defer alias.Close()
+	lh.AddVhost(alias)
+	assert.Nil(t, alias.health)
+
+	r := httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://old.local/", nil))
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "old.local", r.Body.String())
+
+	// target gone
+	lh.RemoveVhost("new.local")
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://old.local/", nil))
+	assert.Equal(t, 404, r.Code)
+	assert.Contains(t, r.Body.String(), "host not found: new.local")
+
+	_, err = CreateVhostWithOptions("old.local", false, VhostOptions{AliasOf: "old.local"})
+	assert.NotNil(t, err)
+}
+
+func TestAliasRegistration(t *testing.T) {
+	reset()
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+
+	r := httptest.NewRecorder()
+	d.addVhostWithOptions("old.local", VhostOptions{AliasOf: "missing.local"}, r)
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+	assert.Nil(t, lh.GetVhost("old.local"))
+
+	d.addVhost("new.local:8000", httptest.NewRecorder())
+	d.addVhostWithOptions("old.local", VhostOptions{AliasOf: "new.local"}, httptest.NewRecorder())
+	assert.NotNil(t, lh.GetVhost("old.local"))
+
+	// aliases of aliases are not allowed
+	r = httptest.NewRecorder()
+	d.addVhostWithOptions("older.local", VhostOptions{AliasOf: "old.local"}, r)
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+}
+
+func TestAliasSharedCert(t *testing.T) {
+	reset()
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 8443)
+
+	target, err := CreateVhostWithOptions("shared.local:8000", true, VhostOptions{})
+	assert.Nil(t, err)
+	lh.AddVhost(target)
+	for _, host := range []string{"b.shared.local", "a.shared.local"} {
+		alias, err := CreateVhostWithOptions(host, true, VhostOptions{AliasOf: "shared.local"})
+		assert.Nil(t, err)
+		lh.AddVhost(alias)
+	}
+
+	assert.True(t, d.shareAliasCerts())
+	assert.False(t, d.shareAliasCerts())
+	cert := lh.GetVhost("shared.local").Cert
+	assert.Equal(t, cert, lh.GetVhost("a.shared.local").Cert)
+	assert.Equal(t, cert, lh.GetVhost("b.shared.local").Cert)
+
+	name := strings.TrimSuffix(filepath.Base(cert), ".pem")
+	assert.Equal(t, "shared.local+2", name)
+	assert.True(t, d.certInUse(name))
+	info, err := inspectCertFile("shared.local", cert, lh.GetVhost("shared.local").Key)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"shared.local", "a.shared.local", "b.shared.local"}, info.SANs)
+}
+
+func TestRemoveAliasTarget(t *testing.T) {
+	reset()
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 8443)
+
+	target, err := CreateVhostWithOptions("removed.local:8000", true, VhostOptions{})
+	assert.Nil(t, err)
+	lh.AddVhost(target)
+	addAlias := func(host string) {
+		alias, err := CreateVhostWithOptions(host, true, VhostOptions{AliasOf: "removed.local"})
+		assert.Nil(t, err)
+		lh.AddVhost(alias)
+	}
+	addAlias("a.removed.local")
+	addAlias("b.removed.local")
+	d.shareAliasCerts()
+	shared := target.Cert
+	assert.Equal(t, "removed.local+2", certName(shared))
+
+	// remaining alias gets a cert without the removed name
+	d.doRemoveVhost(lh.GetVhost("b.removed.local"), httptest.NewRecorder())
+	assert.Nil(t, lh.GetVhost("b.removed.local"))
+	assert.Equal(t, "removed.local+1", certName(target.Cert))
+	assert.Equal(t, target.Cert, lh.GetVhost("a.removed.local").Cert)
+	_, err = os.Stat(shared)
+	assert.True(t, os.IsNotExist(err))
+
+	// and without aliases, the target uses its own cert again
+	shared = target.Cert
+	d.doRemoveVhost(lh.GetVhost("a.removed.local"), httptest.NewRecorder())
+	assert.Equal(t, "removed.local", certName(target.Cert))
+	_, err = os.Stat(shared)
+	assert.True(t, os.IsNotExist(err))
+
+	// removing the target removes its aliases too
+	addAlias("a.removed.local")
+	d.shareAliasCerts()
+	shared = target.Cert
+	r := httptest.NewRecorder()
+	d.doRemoveVhost(target, r)
+	assert.Contains(t, r.Body.String(), "removing vhost: a.removed.local -> removed.local")
+	assert.Equal(t, 0, len(lh.vhostMux.Servers))
+	_, err = os.Stat(shared)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,214 @@
+package vproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// replayKey marks a request as a replay of a retained exchange
+type replayKey struct{}
+
+type replayState struct {
+	of     string    // ID of the original exchange
+	result *Exchange // the new exchange, once served
+}
+
+// discardWriter is the response writer used for replays; the response is
+// recorded as an exchange rather than written anywhere
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// replayRequest handler re-issues a retained request through the vhost's
+// handler and returns the new exchange.
+//
+// Form values:
+//
+//	host     vhost name
+//	id       exchange ID (or request ID) to replay
+//	request  optional raw HTTP request replacing the original
+//	header   optional "Name: value" overrides (empty value removes the header)
+//	body     optional replacement body (used when replace_body=true)
+func (d *Daemon) replayRequest(w http.ResponseWriter, r *http.Request) {
+	vhost, ok := d.inspectVhost(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.FormValue("id")
+	orig := vhost.exchanges.Get(id)
+	if orig == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error: request '%s' not found\n", id)
+		return
+	}
+
+	var body []byte
+	replaceBody := r.FormValue("replace_body") == "true"
+	if replaceBody {
+		body = []byte(r.FormValue("body"))
+	}
+	req, err := buildReplay(orig, r.FormValue("request"), body, replaceBody)
+	if err == nil {
+		err = applyHeaderOverrides(req.Header, r.Form["header"])
+	}
+	if err == nil {
+		err = d.checkReplayTarget(req)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+
+	state := &replayState{of: orig.ID}
+	req = req.WithContext(context.WithValue(r.Context(), replayKey{}, state))
+	d.loggedHandler.ServeHTTP(&discardWriter{header: http.Header{}}, req)
+	if state.result == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error: replay was not recorded")
+		return
+	}
+
+	if r.FormValue("format") == LogFormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state.result)
+		return
+	}
+	writeExchange(w, state.result)
+}
+
+// checkReplayTarget rejects replays to vhosts which require a client cert,
+// which would always be refused since the original cert isn't retained
+func (d *Daemon) checkReplayTarget(req *http.Request) error {
+	lh := d.loggedHandler
+	if target := lh.GetVhost(getHostName(req.Host)); target != nil && lh.tlsOpts(target).ClientAuth == "require" {
+		return fmt.Errorf("can't replay to %s: it requires a client certificate, which is not retained", target.Host)
+	}
+	return nil
+}
+
+// buildReplay creates a new request from the original exchange, or from the
+// given raw (possibly edited) request text
+func buildReplay(orig *Exchange, raw string, body []byte, replaceBody bool) (*http.Request, error) {
+	o := orig.Request
+	method, uri, header := o.Method, o.URI, o.Header.Clone()
+	if raw != "" {
+		var rawBody []byte
+		var err error
+		method, uri, header, rawBody, err = parseRawRequest(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !replaceBody {
+			body = rawBody
+		}
+	} else if !replaceBody {
+		if o.Truncated {
+			return nil, fmt.Errorf("request body was truncated at %d of %d bytes; provide a replacement body", len(o.Body), o.BodySize)
+		}
+		body = o.Body
+	}
+
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	// credentials weren't retained; they must be given with --header
+	for _, name := range redactedHeaders {
+		if header.Get(name) == redactedValue {
+			header.Del(name)
+		}
+	}
+	// a replay is a new request, so gets its own ID and trace
+	header.Del("Content-Length")
+	header.Del(HeaderRequestID)
+	header.Del(HeaderTraceparent)
+	req.Header = header
+	req.ContentLength = int64(len(body))
+	req.RequestURI = uri
+	req.Host = o.Host
+	if h := header.Get("Host"); h != "" {
+		req.Host = h
+		header.Del("Host")
+	}
+	req.RemoteAddr = o.RemoteAddr
+	if o.TLS != "" {
+		version, _ := parseTLSVersion(o.TLS)
+		req.TLS = &tls.ConnectionState{Version: version, HandshakeComplete: true, ServerName: getHostName(req.Host)}
+	}
+	return req, nil
+}
+
+// parseRawRequest parses an HTTP/1.x request as written by `vproxy replay --edit`.
+// Everything after the blank line following the headers is the body.
+func parseRawRequest(raw string) (method string, uri string, header http.Header, body []byte, err error) {
+	raw = strings.ReplaceAll(raw, "\r\n", "\n")
+	head, rest, _ := strings.Cut(raw, "\n\n")
+	head = strings.ReplaceAll(strings.TrimSpace(head), "\n", "\r\n") + "\r\n\r\n"
+
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(head)))
+	if err != nil {
+		return "", "", nil, nil, fmt.Errorf("invalid request: %w", err)
+	}
+	header = req.Header
+	if req.Host != "" {
+		header.Set("Host", req.Host)
+	}
+	return req.Method, req.RequestURI, header, []byte(rest), nil
+}
+
+// applyHeaderOverrides sets (or removes, if the value is empty) the given
+// "Name: value" headers
+func applyHeaderOverrides(h http.Header, overrides []string) error {
+	for _, o := range overrides {
+		name, value, ok := strings.Cut(o, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("invalid header '%s' (expected 'Name: value')", o)
+		}
+		if value = strings.TrimSpace(value); value == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, value)
+		}
+	}
+	return nil
+}
+
+// RawRequest formats the exchange's request as HTTP/1.1 text for editing
+func (ex *Exchange) RawRequest() string {
+	var b strings.Builder
+	req := ex.Request
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\nHost: %s\n", req.Method, req.URI, req.Host)
+	h := req.Header.Clone()
+	h.Del("Content-Length")
+	h.Write(&headerWriter{&b})
+	b.WriteString("\n")
+	b.Write(req.Body)
+	return b.String()
+}
+
+// headerWriter converts CRLF line endings to LF for easier editing
+type headerWriter struct {
+	w io.StringWriter
+}
+
+func (h *headerWriter) Write(p []byte) (int, error) {
+	_, err := h.w.WriteString(strings.ReplaceAll(string(p), "\r\n", "\n"))
+	return len(p), err
+}
@@ -0,0 +1,87 @@
+package vproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplay(t *testing.T) {
+	reset()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get("X-Sig"), r.URL.RequestURI(), b)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	d := NewDaemon(lh, "", 0, 0)
+	vhost, err := CreateVhost("hook.local:"+u.Port(), false)
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	req := httptest.NewRequest("POST", "http://hook.local/webhook", strings.NewReader(`{"event":"push"}`))
+	req.Header.Set("X-Sig", "abc")
+	req.Header.Set("Authorization", "Bearer secret")
+	lh.ServeHTTP(httptest.NewRecorder(), req)
+
+	// retained without capture, but without response body
+	orig := vhost.exchanges.Get("1")
+	assert.NotNil(t, orig)
+	assert.Equal(t, `{"event":"push"}`, string(orig.Request.Body))
+	assert.False(t, orig.Response.Captured)
+
+	// redacted credentials aren't sent
+	replay, err := buildReplay(orig, "", nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "", replay.Header.Get("Authorization"))
+
+	form := url.Values{"host": {"hook.local"}, "id": {"1"}}
+	r := httptest.NewRecorder()
+	d.replayRequest(r, httptest.NewRequest("POST", "/_vproxy/replay?"+form.Encode(), nil))
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Contains(t, r.Body.String(), "replay-of=#1")
+	assert.Contains(t, r.Body.String(), `abc /webhook {"event":"push"}`)
+
+	// modified headers and body
+	form.Add("header", "X-Sig: def")
+	form.Set("replace_body", "true")
+	form.Set("body", "{}")
+	r = httptest.NewRecorder()
+	d.replayRequest(r, httptest.NewRequest("POST", "/_vproxy/replay?"+form.Encode(), nil))
+	assert.Contains(t, r.Body.String(), `def /webhook {}`)
+
+	// edited raw request
+	form = url.Values{"host": {"hook.local"}, "id": {"1"}}
+	raw := strings.Replace(orig.RawRequest(), "/webhook", "/webhook?retry=1", 1)
+	form.Set("request", raw)
+	r = httptest.NewRecorder()
+	d.replayRequest(r, httptest.NewRequest("POST", "/_vproxy/replay?"+form.Encode(), nil))
+	assert.Contains(t, r.Body.String(), `abc /webhook?retry=1 {"event":"push"}`)
+
+	exchanges := vhost.exchanges.List()
+	assert.Equal(t, 4, len(exchanges))
+	assert.Equal(t, "1", exchanges[3].ReplayOf)
+	assert.True(t, exchanges[3].Response.Captured)
+
+	// header values may contain commas
+	form = url.Values{"host": {"hook.local"}, "id": {"1"}, "header": {"X-Sig: a, b"}}
+	r = httptest.NewRecorder()
+	d.replayRequest(r, httptest.NewRequest("POST", "/_vproxy/replay?"+form.Encode(), nil))
+	assert.Contains(t, r.Body.String(), `a, b /webhook`)
+
+	// vhosts requiring a client cert can't be replayed to
+	vhost.Options.ClientAuth = "require"
+	form = url.Values{"host": {"hook.local"}, "id": {"1"}}
+	r = httptest.NewRecorder()
+	d.replayRequest(r, httptest.NewRequest("POST", "/_vproxy/replay?"+form.Encode(), nil))
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+	assert.Contains(t, r.Body.String(), "requires a client certificate")
+}
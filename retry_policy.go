@@ -0,0 +1,231 @@
+package vproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// RetryPolicy controls when a failed upstream request is retried. Empty values
+// use the defaults below.
+type RetryPolicy struct {
+	RetryTimeout     string   `json:"retry_timeout,omitempty"`      // max time spent retrying, e.g. "10s"
+	RetryMaxAttempts int      `json:"retry_max_attempts,omitempty"` // including the first (default: unlimited)
+	RetryMethods     []string `json:"retry_methods,omitempty"`      // methods which may be resent after reaching the upstream
+	RetryOn          []string `json:"retry_on,omitempty"`           // see RetryConditions
+	RetryBodyLimit   int      `json:"retry_body_limit,omitempty"`   // max request body bytes buffered for resending
+}
+
+// Conditions for retrying a request
+const (
+	RetryOnConnect = "connect" // upstream refused or unreachable; nothing was sent
+	RetryOnReset   = "reset"   // connection reset or closed mid-request
+	RetryOnTimeout = "timeout"
+	RetryOn502     = "502"
+	RetryOn503     = "503"
+	RetryOn504     = "504"
+)
+
+// RetryConditions lists the valid values for RetryOn
+var RetryConditions = []string{RetryOnConnect, RetryOnReset, RetryOnTimeout, RetryOn502, RetryOn503, RetryOn504}
+
+// Retry defaults
+var (
+	defaultRetryTimeout   = 30 * time.Second
+	defaultRetryMethods   = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+	defaultRetryOn        = []string{RetryOnConnect}
+	defaultRetryBodyLimit = 1 << 20
+)
+
+// Validate the policy
+func (p RetryPolicy) Validate() error {
+	if p.RetryTimeout != "" {
+		if d, err := time.ParseDuration(p.RetryTimeout); err != nil || d < 0 {
+			return fmt.Errorf("invalid retry timeout '%s'", p.RetryTimeout)
+		}
+	}
+	if p.RetryMaxAttempts < 0 || p.RetryBodyLimit < 0 {
+		return fmt.Errorf("invalid retry max attempts or body limit")
+	}
+	for _, m := range p.RetryMethods {
+		if m == "" || strings.ContainsAny(m, " \t/") {
+			return fmt.Errorf("invalid retry method '%s'", m)
+		}
+	}
+	for _, c := range p.RetryOn {
+		if !contains(RetryConditions, strings.ToLower(c)) {
+			return fmt.Errorf("invalid retry condition '%s' (expected one of: %s)", c, strings.Join(RetryConditions, ", "))
+		}
+	}
+	return nil
+}
+
+func (p RetryPolicy) timeout() time.Duration {
+	if d, err := time.ParseDuration(p.RetryTimeout); err == nil {
+		return d
+	}
+	return defaultRetryTimeout
+}
+
+func (p RetryPolicy) methods() []string {
+	if len(p.RetryMethods) > 0 {
+		return p.RetryMethods
+	}
+	return defaultRetryMethods
+}
+
+func (p RetryPolicy) conditions() []string {
+	if len(p.RetryOn) > 0 {
+		return p.RetryOn
+	}
+	return defaultRetryOn
+}
+
+func (p RetryPolicy) bodyLimit() int {
+	if p.RetryBodyLimit > 0 {
+		return p.RetryBodyLimit
+	}
+	return defaultRetryBodyLimit
+}
+
+// resendsBody returns true if a request with the given method may be retried
+// after reaching the upstream, in which case its body must be buffered first.
+// Connect errors alone never require it, as nothing was sent.
+func (p RetryPolicy) resendsBody(method string) bool {
+	if p.timeout() == 0 || p.RetryMaxAttempts == 1 || !contains(p.methods(), method) {
+		return false
+	}
+	for _, c := range p.conditions() {
+		if !strings.EqualFold(c, RetryOnConnect) {
+			return true
+		}
+	}
+	return false
+}
+
+// backOff for a single request. A zero timeout disables retries.
+func (p RetryPolicy) backOff() backoff.BackOff {
+	if p.timeout() == 0 {
+		return &backoff.StopBackOff{}
+	}
+	be := backoff.NewExponentialBackOff()
+	be.MaxElapsedTime = p.timeout()
+	if p.RetryMaxAttempts > 0 {
+		return backoff.WithMaxRetries(be, uint64(p.RetryMaxAttempts-1))
+	}
+	return be
+}
+
+// retryCondition returns the condition matched by the attempt's result, or ""
+// if it should not be retried. Connect errors are safe to retry for any
+// method since the request never reached the upstream; anything else is only
+// retried for the configured methods.
+func (p RetryPolicy) retryCondition(method string, res *http.Response, err error) string {
+	cond := ""
+	if err != nil {
+		cond = errorCondition(err)
+	} else if res.StatusCode == 502 || res.StatusCode == 503 || res.StatusCode == 504 {
+		cond = strconv.Itoa(res.StatusCode)
+	}
+	if cond == "" || !contains(p.conditions(), cond) {
+		return ""
+	}
+	if cond != RetryOnConnect && !contains(p.methods(), method) {
+		return ""
+	}
+	return cond
+}
+
+func errorCondition(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return RetryOnConnect
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RetryOnTimeout
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryOnReset
+	}
+	return ""
+}
+
+// bufferBody so the request can be resent, setting GetBody. If the body is
+// larger than the limit, it is left intact without GetBody.
+func bufferBody(r *http.Request, limit int) error {
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil {
+		return err
+	}
+	if len(buf) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil
+	}
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}
+
+// unreadBody wraps a request body which was not buffered, so that the request
+// can still be resent after a connect error, as long as none of the body was
+// read. Close is ignored, as the transport closes the body on any error; the
+// server closes the original body once the request is done.
+type unreadBody struct {
+	io.ReadCloser
+	read atomic.Bool
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.read.Store(true)
+	}
+	return n, err
+}
+
+func (b *unreadBody) Close() error {
+	return nil
+}
+
+// rewindBody before resending the request
+func rewindBody(r *http.Request) error {
+	if r.GetBody == nil {
+		return nil
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
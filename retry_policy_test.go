@@ -0,0 +1,151 @@
+package vproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyUpstream fails with the given status until it has been hit `failures`
+// times, echoing the request body once it succeeds
+func flakyUpstream(status int, failures int32) (*httptest.Server, *int32) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&hits, 1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write(body)
+	}))
+	return upstream, &hits
+}
+
+func proxyTo(t *testing.T, upstream string, retry RetryPolicy) http.Handler {
+	u, err := url.Parse(upstream)
+	assert.Nil(t, err)
+	return CreateProxyWithOptions(*u, "retry.local", VhostOptions{RetryPolicy: retry})
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	upstream, hits := flakyUpstream(503, 2)
+	defer upstream.Close()
+	proxy := proxyTo(t, upstream.URL, RetryPolicy{RetryOn: []string{"connect", "503"}, RetryTimeout: "5s"})
+
+	// idempotent request is retried, with its body intact
+	r := httptest.NewRecorder()
+	proxy.ServeHTTP(r, httptest.NewRequest("PUT", "http://retry.local/", strings.NewReader("hello")))
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "hello", r.Body.String())
+	assert.Equal(t, int32(3), atomic.LoadInt32(hits))
+
+	// POST may have been processed; the upstream's response is passed along
+	atomic.StoreInt32(hits, 0)
+	r = httptest.NewRecorder()
+	proxy.ServeHTTP(r, httptest.NewRequest("POST", "http://retry.local/", strings.NewReader("hello")))
+	assert.Equal(t, 503, r.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	upstream, hits := flakyUpstream(502, 10)
+	defer upstream.Close()
+	proxy := proxyTo(t, upstream.URL, RetryPolicy{RetryOn: []string{"502"}, RetryMaxAttempts: 2})
+
+	r := httptest.NewRecorder()
+	proxy.ServeHTTP(r, httptest.NewRequest("GET", "http://retry.local/", nil))
+	assert.Equal(t, 502, r.Code)
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits))
+}
+
+func TestRetryBodyLimit(t *testing.T) {
+	upstream, hits := flakyUpstream(503, 1)
+	defer upstream.Close()
+	proxy := proxyTo(t, upstream.URL, RetryPolicy{RetryOn: []string{"503"}, RetryBodyLimit: 4})
+
+	// body is too large to buffer, so it is sent once and never resent
+	r := httptest.NewRecorder()
+	proxy.ServeHTTP(r, httptest.NewRequest("PUT", "http://retry.local/", strings.NewReader("hello world")))
+	assert.Equal(t, 503, r.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	// but it is still retried after connect errors, when nothing was sent
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		if ln, err := net.Listen("tcp", addr); err == nil {
+			http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, r.Body)
+			}))
+		}
+	}()
+	proxy = proxyTo(t, "http://"+addr, RetryPolicy{RetryOn: []string{"connect", "503"}, RetryBodyLimit: 4})
+	r = httptest.NewRecorder()
+	proxy.ServeHTTP(r, httptest.NewRequest("PUT", "http://retry.local/", strings.NewReader("hello world")))
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "hello world", r.Body.String())
+}
+
+func TestRetryConnect(t *testing.T) {
+	upstream, _ := flakyUpstream(200, 0)
+	addr := upstream.URL
+	upstream.Close()
+	proxy := proxyTo(t, addr, RetryPolicy{RetryMaxAttempts: 2})
+
+	r := httptest.NewRecorder()
+	proxy.ServeHTTP(r, httptest.NewRequest("POST", "http://retry.local/", strings.NewReader("hello")))
+	assert.Equal(t, 503, r.Code)
+	assert.Equal(t, ErrorUpstreamDown, r.Header().Get(HeaderError))
+}
+
+func TestRetryConnectUnbuffered(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// upstream comes up while the request is being retried
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		if ln, err := net.Listen("tcp", addr); err == nil {
+			http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, r.Body)
+			}))
+		}
+	}()
+
+	// connect-only retries don't buffer the body, which is still sent intact
+	proxy := proxyTo(t, "http://"+addr, RetryPolicy{})
+	r := httptest.NewRecorder()
+	proxy.ServeHTTP(r, httptest.NewRequest("POST", "http://retry.local/", strings.NewReader("hello")))
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "hello", r.Body.String())
+
+	assert.False(t, RetryPolicy{}.resendsBody("PUT"))
+	assert.False(t, RetryPolicy{RetryOn: []string{"503"}}.resendsBody("POST"))
+	assert.False(t, RetryPolicy{RetryOn: []string{"503"}, RetryTimeout: "0s"}.resendsBody("PUT"))
+	assert.True(t, RetryPolicy{RetryOn: []string{"connect", "503"}}.resendsBody("PUT"))
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	assert.Nil(t, RetryPolicy{RetryTimeout: "500ms", RetryOn: []string{"connect", "503"}}.Validate())
+	assert.NotNil(t, RetryPolicy{RetryTimeout: "soon"}.Validate())
+	assert.NotNil(t, RetryPolicy{RetryOn: []string{"418"}}.Validate())
+	assert.NotNil(t, RetryPolicy{RetryMaxAttempts: -1}.Validate())
+
+	p := RetryPolicy{RetryOn: []string{"connect", "reset"}}
+	assert.Equal(t, "", p.retryCondition("GET", &http.Response{StatusCode: 503}, nil))
+	assert.Equal(t, "reset", p.retryCondition("GET", nil, io.ErrUnexpectedEOF))
+	assert.Equal(t, "", p.retryCondition("POST", nil, io.ErrUnexpectedEOF))
+	assert.Equal(t, "", p.retryCondition("GET", nil, fmt.Errorf("something else")))
+}
@@ -0,0 +1,129 @@
+package vproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// responseRewriter maps upstream URLs in response headers (redirects, cookie
+// domains) to the public vhost URL, for apps which don't know they are behind a
+// proxy
+type responseRewriter struct {
+	vhost    string
+	upstream url.URL
+}
+
+// loopback names which also refer to the upstream
+var loopbackHosts = []string{"localhost", "127.0.0.1", "::1", "0.0.0.0"}
+
+func (rw *responseRewriter) rewrite(res *http.Response) {
+	if rw.vhost == "" || res.Request == nil {
+		return
+	}
+	origin := publicOrigin(res.Request, rw.vhost)
+
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := res.Header.Get(name); v != "" {
+			res.Header.Set(name, rw.rewriteURL(v, origin))
+		}
+	}
+	if v := res.Header.Get("Refresh"); v != "" {
+		res.Header.Set("Refresh", rw.rewriteRefresh(v, origin))
+	}
+	if cookies := res.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		res.Header.Del("Set-Cookie")
+		for _, c := range cookies {
+			res.Header.Add("Set-Cookie", rw.rewriteCookie(c, origin))
+		}
+	}
+}
+
+// publicOrigin is the scheme, vhost and (non-default) port the client used
+func publicOrigin(r *http.Request, vhost string) *url.URL {
+	origin := &url.URL{Scheme: "http", Host: vhost}
+	if r.TLS != nil {
+		origin.Scheme = "https"
+	}
+	if port := localPort(r); port != "" && !isDefaultPort(origin.Scheme, port) {
+		origin.Host = net.JoinHostPort(vhost, port)
+	}
+	return origin
+}
+
+// localPort the request was received on, if known
+func localPort(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	return ""
+}
+
+func isDefaultPort(scheme string, port string) bool {
+	return (scheme == "http" && port == "80") || (scheme == "https" && port == "443")
+}
+
+// isUpstream returns true if the host:port refers to the upstream
+func (rw *responseRewriter) isUpstream(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "80"
+	}
+	return port == rw.upstream.Port() && rw.isUpstreamHost(host)
+}
+
+func (rw *responseRewriter) isUpstreamHost(host string) bool {
+	host = strings.Trim(strings.ToLower(host), "[]")
+	return host == rw.upstream.Hostname() || contains(loopbackHosts, host)
+}
+
+// rewriteURL if it points at the upstream, or at the vhost with the wrong
+// scheme (e.g., an app which assumes plain HTTP)
+func (rw *responseRewriter) rewriteURL(raw string, origin *url.URL) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw // relative
+	}
+	if rw.isUpstream(u.Host) || (strings.EqualFold(u.Hostname(), rw.vhost) && u.Scheme != origin.Scheme) {
+		if u.Scheme != "" {
+			u.Scheme = origin.Scheme
+		}
+		u.Host = origin.Host
+		return u.String()
+	}
+	return raw
+}
+
+// rewriteRefresh header, e.g. "5; url=http://127.0.0.1:5000/"
+func (rw *responseRewriter) rewriteRefresh(v string, origin *url.URL) string {
+	i := strings.Index(strings.ToLower(v), "url=")
+	if i < 0 {
+		return v
+	}
+	return v[:i+4] + rw.rewriteURL(strings.TrimSpace(v[i+4:]), origin)
+}
+
+// rewriteCookie Domain attributes which refer to the upstream, and drop the
+// Secure attribute if the client is on plain HTTP (where it would be rejected)
+func (rw *responseRewriter) rewriteCookie(line string, origin *url.URL) string {
+	parts := strings.Split(line, ";")
+	out := []string{parts[0]}
+	for _, attr := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			if rw.isUpstreamHost(strings.TrimPrefix(value, ".")) {
+				attr = " Domain=" + rw.vhost
+			}
+		case "secure":
+			if origin.Scheme == "http" {
+				continue
+			}
+		}
+		out = append(out, attr)
+	}
+	return strings.Join(out, ";")
+}
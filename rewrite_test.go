@@ -0,0 +1,61 @@
+package vproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteResponse(t *testing.T) {
+	rw := &responseRewriter{vhost: "app.local", upstream: url.URL{Scheme: "http", Host: "127.0.0.1:5000"}}
+	https := &url.URL{Scheme: "https", Host: "app.local"}
+	plain := &url.URL{Scheme: "http", Host: "app.local:8080"}
+
+	assert.Equal(t, "https://app.local/login?next=%2F", rw.rewriteURL("http://127.0.0.1:5000/login?next=%2F", https))
+	assert.Equal(t, "https://app.local/x", rw.rewriteURL("http://localhost:5000/x", https))
+	assert.Equal(t, "https://app.local/x", rw.rewriteURL("http://app.local/x", https))
+	assert.Equal(t, "http://app.local:8080/x", rw.rewriteURL("http://127.0.0.1:5000/x", plain))
+	assert.Equal(t, "/relative", rw.rewriteURL("/relative", https))
+	assert.Equal(t, "http://127.0.0.1:6000/other", rw.rewriteURL("http://127.0.0.1:6000/other", https))
+	assert.Equal(t, "https://example.com/", rw.rewriteURL("https://example.com/", https))
+
+	assert.Equal(t, "0; url=https://app.local/done", rw.rewriteRefresh("0; url=http://127.0.0.1:5000/done", https))
+	assert.Equal(t, "5", rw.rewriteRefresh("5", https))
+
+	assert.Equal(t, "sid=abc; Path=/; Domain=app.local; Secure; HttpOnly",
+		rw.rewriteCookie("sid=abc; Path=/; Domain=localhost; Secure; HttpOnly", https))
+	assert.Equal(t, "sid=abc; Domain=app.local; HttpOnly",
+		rw.rewriteCookie("sid=abc; Domain=.127.0.0.1; Secure; HttpOnly", plain))
+	assert.Equal(t, "sid=abc; Domain=example.com", rw.rewriteCookie("sid=abc; Domain=example.com", https))
+}
+
+func TestRewriteResponseProxy(t *testing.T) {
+	reset()
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", upstream.URL+"/next")
+		w.Header().Add("Set-Cookie", "a=1; Domain=localhost")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	proxy := CreateProxyWithOptions(*u, "app.local", VhostOptions{})
+	req := httptest.NewRequest("GET", "https://app.local/", nil)
+	req.TLS = &tls.ConnectionState{}
+	r := httptest.NewRecorder()
+	proxy.ServeHTTP(r, req)
+	assert.Equal(t, "https://app.local/next", r.Header().Get("Location"))
+	assert.Equal(t, "a=1; Domain=app.local", r.Header().Get("Set-Cookie"))
+
+	// opt out
+	off := false
+	proxy = CreateProxyWithOptions(*u, "app.local", VhostOptions{RewriteResponses: &off})
+	r = httptest.NewRecorder()
+	proxy.ServeHTTP(r, req)
+	assert.Equal(t, upstream.URL+"/next", r.Header().Get("Location"))
+}
@@ -2,10 +2,16 @@ package vproxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"time"
@@ -13,18 +19,17 @@ import (
 	"github.com/cenkalti/backoff/v4"
 )
 
-var badGatewayMessage = `<html>
-<body>
-<h1>503 Service Unavailable</h1>
-<p>Can't connect to upstream server (%s &mdash;&gt; %s), please try again later.</p>
-</body>
-</html>`
+// How often the "upstream starting" page checks whether the upstream is up
+var upstreamDownRefresh = 2
 
 // proxyTransport is a simple http.RoundTripper implementation which returns a
-// 503 on any error making a request to the upstream (backend) service
+// 503 (or 504 on timeout) error page on any error making a request to the
+// upstream (backend) service
 type proxyTransport struct {
-	transport *http.Transport
-	errMsg    string
+	transport  *http.Transport
+	vhost      string
+	retry      RetryPolicy
+	errorPages string
 }
 
 func (t *proxyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -34,33 +39,110 @@ func (t *proxyTransport) RoundTrip(request *http.Request) (*http.Response, error
 		err      error
 	)
 
-	operation := func() error {
+	trace := upstreamTraceFrom(request.Context())
+	if trace != nil {
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace.clientTrace()))
+	}
+
+	// only buffer the body if the request may be resent after reaching the
+	// upstream. A body which isn't (or is too large to be) buffered can still
+	// be resent after a connect error, as none of it was sent.
+	var unread *unreadBody
+	if t.retry.resendsBody(request.Method) {
+		if err = bufferBody(request, t.retry.bodyLimit()); err != nil {
+			return t.errorResponse(request, err), nil
+		}
+	}
+	if request.GetBody == nil && request.Body != nil && request.Body != http.NoBody {
+		unread = &unreadBody{ReadCloser: request.Body}
+		request.Body = unread
+	}
+
+	be := backoff.WithContext(t.retry.backOff(), request.Context())
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			metrics.retry(t.vhost)
+			if err = rewindBody(request); err != nil {
+				break
+			}
+		}
+		trace.attempt()
 		response, err = t.transport.RoundTrip(request)
-		// Handle Retry-After here, if you wish...
-		// If err is nil, no retry will occur
-		return err
+
+		cond := t.retry.retryCondition(request.Method, response, err)
+		if cond == "" {
+			break
+		}
+		if unread != nil && unread.read.Load() {
+			// never resend a request whose body was already (partly) consumed
+			log.Printf("proxy: not retrying %s %s (%s): request body can't be resent", request.Method, request.URL.Path, cond)
+			break
+		}
+		wait := be.NextBackOff()
+		if wait == backoff.Stop {
+			break
+		}
+		if response != nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			response = nil
+		}
+		select {
+		case <-request.Context().Done():
+			err = request.Context().Err()
+		case <-time.After(wait):
+			continue
+		}
+		break
 	}
 
-	be := backoff.NewExponentialBackOff()
-	be.MaxElapsedTime = time.Second * 30
-	err = backoff.Retry(operation, be)
 	if err != nil {
-		resp := &http.Response{
-			StatusCode: http.StatusServiceUnavailable,
-			Body:       ioutil.NopCloser(bytes.NewBufferString(t.errMsg)),
-		}
+		return t.errorResponse(request, err), nil
+	}
+	return response, nil
+}
 
-		resp.StatusCode = 503
-		resp.Status = "Can't connect to upstream server"
-		log.Println("proxy: error fetching from upstream:", err)
-		return resp, nil
+// errorResponse when the upstream could not be reached
+func (t *proxyTransport) errorResponse(request *http.Request, err error) *http.Response {
+	page := upstreamErrorPage(t.vhost, request, err)
+	header, body := page.render(request, t.errorPages)
+	resp := &http.Response{
+		StatusCode:    page.Status,
+		Status:        page.Title(),
+		Request:       request,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
 	}
 
-	return response, err
+	log.Println("proxy: error fetching from upstream:", err)
+	metrics.upstreamError(t.vhost)
+	events.publish(Event{Type: EventUpstreamError, Host: t.vhost, Upstream: request.URL.Host, Error: err.Error()})
+	return resp
+}
+
+// upstreamErrorPage for the given request error
+func upstreamErrorPage(vhost string, request *http.Request, err error) *ErrorPage {
+	page := &ErrorPage{
+		Kind:      ErrorUpstreamDown,
+		Status:    http.StatusServiceUnavailable,
+		Message:   fmt.Sprintf("Can't connect to upstream server (%s -> %s), please try again later.", vhost, request.URL.Host),
+		Host:      vhost,
+		Upstream:  request.URL.Host,
+		RequestID: request.Header.Get(HeaderRequestID),
+		Refresh:   upstreamDownRefresh,
+	}
+	if err != nil && (errorCondition(err) == RetryOnTimeout || errors.Is(err, context.DeadlineExceeded)) {
+		page.Kind = ErrorUpstreamTimeout
+		page.Status = http.StatusGatewayTimeout
+		page.Message = fmt.Sprintf("Upstream server timed out (%s -> %s).", vhost, request.URL.Host)
+		page.Refresh = 0
+	}
+	return page
 }
 
-func createProxyTransport(targetURL url.URL, vhost string) *proxyTransport {
-	t := &proxyTransport{errMsg: fmt.Sprintf(badGatewayMessage, targetURL.String(), vhost)}
+func createProxyTransport(targetURL url.URL, vhost string, opts VhostOptions) *proxyTransport {
+	t := &proxyTransport{vhost: vhost, retry: opts.RetryPolicy, errorPages: opts.ErrorPages}
 	t.transport = http.DefaultTransport.(*http.Transport).Clone()
 	t.transport.MaxConnsPerHost = 0 // unlim
 	t.transport.MaxIdleConns = 800
@@ -71,23 +153,80 @@ func createProxyTransport(targetURL url.URL, vhost string) *proxyTransport {
 // CreateProxy with custom http.RoundTripper impl. Sets proper host headers
 // using given vhost name.
 func CreateProxy(targetURL url.URL, vhost string) *httputil.ReverseProxy {
+	return CreateProxyWithOptions(targetURL, vhost, DefaultVhostOptions)
+}
+
+// CreateProxyWithOptions using the retry policy, forwarded headers, header
+// rules, response rewriting, compression, caching and error pages from the
+// given options
+func CreateProxyWithOptions(targetURL url.URL, vhost string, opts VhostOptions) *httputil.ReverseProxy {
+	// rules were validated along with the options
+	requestRules, _ := parseHeaderRules(opts.RequestHeaders)
+	responseRules, _ := parseHeaderRules(opts.ResponseHeaders)
+	var rewriter *responseRewriter
+	if opts.RewriteResponses == nil || *opts.RewriteResponses {
+		rewriter = &responseRewriter{vhost: vhost, upstream: targetURL}
+	}
+	fwd := newForwarder(opts.ForwardedPolicy)
+	compressor := newCompressor(opts.CompressionPolicy)
+	noCache := isTrue(opts.NoCache)
+
 	return &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
 			p, q := r.URL.Path, r.URL.RawQuery
+			host := getHostName(r.Host)
 			*r.URL = targetURL
 			r.URL.Path, r.URL.RawQuery = p, q
+			fwd.setHeaders(r, r.Host)
 			if vhost != "" {
 				r.Host = vhost
-				r.Header.Add("X-Forwarded-Host", vhost)
 			} else {
 				r.Host = targetURL.Host
 			}
-			scheme := "http"
-			if r.TLS != nil {
-				scheme = "https"
+			setClientCertHeaders(r, host, vhost)
+			ensureTraceHeaders(r)
+			if noCache {
+				stripConditionalHeaders(r)
+			}
+			applyHeaderRules(r.Header, requestRules, r)
+		},
+		ModifyResponse: func(res *http.Response) error {
+			if res.Header.Get(HeaderError) == "" {
+				if rewriter != nil {
+					rewriter.rewrite(res)
+				}
+				if noCache {
+					disableCaching(res)
+				}
+				if compressor != nil {
+					compressor.compress(res)
+				}
 			}
-			r.Header.Add("X-Forwarded-Proto", scheme)
+			applyHeaderRules(res.Header, responseRules, res.Request)
+			return nil
 		},
-		Transport: createProxyTransport(targetURL, vhost),
+		Transport: createProxyTransport(targetURL, vhost, opts),
+	}
+}
+
+// setClientCertHeaders passes the verified client cert (mTLS), if any, along
+// to the upstream. Any values sent by the client itself are dropped. The cert
+// is only passed on if it was verified in the handshake for the requested
+// host or the vhost serving it (for an alias), not for some other vhost.
+func setClientCertHeaders(r *http.Request, host, vhost string) {
+	r.Header.Del("X-Client-Cert-Subject")
+	r.Header.Del("X-Client-Cert-Issuer")
+	r.Header.Del("X-Client-Cert-Fingerprint")
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	if r.TLS.ServerName != host && (vhost == "" || r.TLS.ServerName != vhost) {
+		return
 	}
+	cert := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	r.Header.Set("X-Client-Cert-Subject", cert.Subject.String())
+	r.Header.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	r.Header.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(sum[:]))
 }
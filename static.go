@@ -0,0 +1,221 @@
+package vproxy
+
+import (
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// When running as root, only serve files which any local user could read
+// anyway: the control API is unauthenticated, so static vhosts may be
+// registered by any user
+var staticWorldReadable = os.Geteuid() == 0
+
+// content types which may be missing from the system's mime.types
+var staticTypes = map[string]string{
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".map":         "application/json",
+	".json":        "application/json",
+	".wasm":        "application/wasm",
+	".svg":         "image/svg+xml",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".md":          "text/markdown; charset=utf-8",
+	".txt":         "text/plain; charset=utf-8",
+	".webmanifest": "application/manifest+json",
+}
+
+func init() {
+	for ext, typ := range staticTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, typ)
+		}
+	}
+}
+
+// staticHandler serves files from a local directory, for vhosts without an
+// upstream. Range requests, conditional requests and content types are
+// handled by http.FileServer.
+type staticHandler struct {
+	root     http.FileSystem
+	files    http.Handler
+	spa      bool
+	listing  bool
+	errorDir string
+}
+
+func newStaticHandler(dir string, opts VhostOptions) *staticHandler {
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	root := staticFS{root: dir, worldReadable: staticWorldReadable}
+	return &staticHandler{
+		root:     root,
+		files:    http.FileServer(root),
+		spa:      isTrue(opts.SPA),
+		listing:  opts.DirListing == nil || *opts.DirListing,
+		errorDir: opts.ErrorPages,
+	}
+}
+
+func (s *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if isHidden(name) {
+		s.notFound(w, r)
+		return
+	}
+
+	f, err := s.root.Open(name)
+	if err != nil {
+		// client-side routes, e.g. /users/1, are handled by the app
+		if s.spa && path.Ext(name) == "" {
+			s.serveIndex(w, r)
+			return
+		}
+		s.notFound(w, r)
+		return
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+	if fi.IsDir() && !s.listing && !s.exists(path.Join(name, "index.html")) {
+		s.notFound(w, r)
+		return
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+func (s *staticHandler) exists(name string) bool {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// serveIndex for any path (SPA fallback). Served directly, as http.FileServer
+// would redirect requests for /index.html.
+func (s *staticHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	f, err := s.root.Open("/index.html")
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		s.notFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", fi.ModTime(), f)
+}
+
+func (s *staticHandler) notFound(w http.ResponseWriter, r *http.Request) {
+	page := &ErrorPage{
+		Kind:      ErrorNotFound,
+		Status:    http.StatusNotFound,
+		Message:   "file not found: " + r.URL.Path,
+		Host:      getHostName(r.Host),
+		RequestID: r.Header.Get(HeaderRequestID),
+	}
+	page.Serve(w, r, s.errorDir)
+}
+
+// isHidden returns true for paths containing dot files or dirs (e.g., .env or
+// .git), other than .well-known
+func isHidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDir to be served by a static vhost
+func validateDir(dir string) error {
+	return checkDir("static dir", dir)
+}
+
+// checkDir exists and, when running as root, is readable by all users
+func checkDir(kind, dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", kind, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("invalid %s: %s is not a directory", kind, dir)
+	}
+	if staticWorldReadable && !worldReadable(dir) {
+		return fmt.Errorf("invalid %s: %s is not readable by all users (required when the daemon runs as root)", kind, dir)
+	}
+	return nil
+}
+
+// staticFS is an http.FileSystem which, unlike http.Dir, doesn't follow
+// symlinks out of the root
+type staticFS struct {
+	root          string // with symlinks resolved
+	worldReadable bool   // only open files readable by all users
+}
+
+func (s staticFS) Open(name string) (http.File, error) {
+	real, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(s.root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fs.ErrNotExist
+	}
+	if s.worldReadable && !worldReadable(real) {
+		return nil, fs.ErrPermission
+	}
+	return os.Open(real)
+}
+
+// worldReadable returns true if the file (or dir) can be read by all users,
+// including search permission on every parent dir
+func worldReadable(name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	want := fs.FileMode(0004)
+	if fi.IsDir() {
+		want |= 0001
+	}
+	if fi.Mode().Perm()&want != want {
+		return false
+	}
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm()&0001 == 0 {
+			return false
+		}
+		if dir == filepath.Dir(dir) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package vproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticVhost(t *testing.T) {
+	reset()
+	defer func(v bool) { staticWorldReadable = v }(staticWorldReadable)
+	staticWorldReadable = false
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>docs</h1>"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log('hi')"), 0644)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=1"), 0644)
+	os.Mkdir(filepath.Join(dir, "assets"), 0755)
+	os.WriteFile(filepath.Join(dir, "assets", "logo.svg"), []byte("<svg/>"), 0644)
+
+	on := true
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, false))
+	vhost, err := CreateVhostWithOptions("docs.local", false, VhostOptions{Dir: dir, SPA: &on})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+	assert.Equal(t, dir, vhost.upstream())
+	assert.Nil(t, vhost.health)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://docs.local"+path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		r := httptest.NewRecorder()
+		lh.ServeHTTP(r, req)
+		return r
+	}
+
+	r := get("/")
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "<h1>docs</h1>", r.Body.String())
+
+	r = get("/app.js")
+	assert.Equal(t, "text/javascript; charset=utf-8", r.Header().Get("Content-Type"))
+
+	r = get("/app.js", "Range", "bytes=0-6")
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, "console", r.Body.String())
+
+	// SPA fallback for routes, but not for missing assets
+	r = get("/users/1")
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "<h1>docs</h1>", r.Body.String())
+	r = get("/missing.js")
+	assert.Equal(t, 404, r.Code)
+	assert.Equal(t, ErrorNotFound, r.Header().Get(HeaderError))
+
+	r = get("/assets/")
+	assert.Equal(t, 200, r.Code)
+	assert.Contains(t, r.Body.String(), `<a href="logo.svg">logo.svg</a>`)
+
+	assert.Equal(t, 404, get("/.env").Code)
+
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("POST", "http://docs.local/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, r.Code)
+
+	// logged like proxied requests
+	time.Sleep(50 * time.Millisecond)
+	logs := vhost.BufferedLogs()
+	assert.Equal(t, 8, len(logs))
+	assert.Equal(t, "/", logs[0].Path)
+
+	// listings disabled
+	off := false
+	vhost, err = CreateVhostWithOptions("docs.local", false, VhostOptions{Dir: dir, DirListing: &off})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+	assert.Equal(t, 404, get("/assets/").Code)
+	assert.Equal(t, 404, get("/users/1").Code)
+
+	_, err = CreateVhostWithOptions("docs.local", false, VhostOptions{Dir: filepath.Join(dir, "nope")})
+	assert.NotNil(t, err)
+	_, err = CreateVhostWithOptions("docs.local", false, VhostOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestStaticConfinement(t *testing.T) {
+	reset()
+	defer func(v bool) { staticWorldReadable = v }(staticWorldReadable)
+	staticWorldReadable = false
+
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>docs</h1>"), 0644)
+	os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "secret.txt"))
+	os.Symlink(outside, filepath.Join(dir, "outside"))
+	os.Symlink("index.html", filepath.Join(dir, "home.html"))
+
+	h := newStaticHandler(dir, VhostOptions{})
+	get := func(path string) int {
+		r := httptest.NewRecorder()
+		h.ServeHTTP(r, httptest.NewRequest("GET", "http://docs.local"+path, nil))
+		return r.Code
+	}
+	assert.Equal(t, 200, get("/home.html"))
+	assert.Equal(t, 404, get("/secret.txt"))
+	assert.Equal(t, 404, get("/outside/secret.txt"))
+	assert.Equal(t, 404, get("/outside/"))
+
+	// as root, only files which any user can read are served
+	staticWorldReadable = true
+	assert.NotNil(t, validateDir(dir)) // t.TempDir is 0700
+	os.Chmod(dir, 0755)
+	os.Chmod(filepath.Dir(dir), 0755)
+	assert.Nil(t, validateDir(dir))
+	os.WriteFile(filepath.Join(dir, "private.txt"), []byte("private"), 0600)
+	h = newStaticHandler(dir, VhostOptions{})
+	assert.Equal(t, 200, get("/"))
+	assert.Equal(t, 404, get("/private.txt"))
+}
@@ -0,0 +1,271 @@
+package vproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TCPAuto picks a free listen port from the daemon's range
+const TCPAuto = "auto"
+
+// Default range of ports for TCP vhosts using TCPAuto
+const defaultTCPPorts = "20000-20999"
+
+// Max ports in a single TCP port range
+const maxTCPPorts = 1000
+
+var tcpDialTimeout = 5 * time.Second
+
+// parsePorts in the form "5432" or "17000-17002"
+func parsePorts(spec string) ([]int, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+	start, err := strconv.Atoi(first)
+	end := start
+	if err == nil && isRange {
+		end, err = strconv.Atoi(last)
+	}
+	if err != nil || start < 1 || end > 65535 || end < start || end-start >= maxTCPPorts {
+		return nil, fmt.Errorf("invalid port or port range '%s' (expected e.g. 5432 or 7000-7010)", spec)
+	}
+	ports := make([]int, 0, end-start+1)
+	for p := start; p <= end; p++ {
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// validateTCP listen spec: a port, port range or "auto"
+func validateTCP(spec string) error {
+	if spec == TCPAuto {
+		return nil
+	}
+	_, err := parsePorts(spec)
+	return err
+}
+
+// tcpForwarder pipes raw TCP connections on one or more ports to the vhost's
+// upstream, optionally terminating TLS with the vhost's cert. A range of
+// listen ports maps onto the same number of upstream ports.
+type tcpForwarder struct {
+	lh        *LoggedHandler
+	host      string
+	listeners []net.Listener
+	tls       bool
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func startTCPForwarder(lh *LoggedHandler, vhost *Vhost, listenHost string, ports []int) (*tcpForwarder, error) {
+	f := &tcpForwarder{lh: lh, host: vhost.Host, conns: map[net.Conn]struct{}{}}
+	if vhost.ServicePort+len(ports)-1 > 65535 {
+		return nil, fmt.Errorf("upstream port range exceeds 65535")
+	}
+
+	var tlsConfig *tls.Config
+	if isTrue(vhost.opts().TCPTLS) {
+		if vhost.Cert == "" {
+			return nil, fmt.Errorf("tcp tls requires the daemon's HTTPS listener to be enabled")
+		}
+		// loaded per connection, so renewed or shared (alias) certs are used
+		base := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(vhost.Cert, vhost.Key)
+			return &cert, err
+		}}
+		var err error
+		if tlsConfig, err = vhostTLSConfig(base, vhost.opts()); err != nil {
+			return nil, err
+		}
+		tlsConfig.NextProtos = nil // not HTTP
+		f.tls = true
+	}
+
+	for i, port := range ports {
+		ln, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
+		if err != nil {
+			f.Stop()
+			return nil, err
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		f.listeners = append(f.listeners, ln)
+		go f.serve(ln, net.JoinHostPort(vhost.ServiceHost, strconv.Itoa(vhost.ServicePort+i)))
+	}
+	return f, nil
+}
+
+// Ports the forwarder is listening on
+func (f *tcpForwarder) Ports() []int {
+	ports := []int{}
+	for _, ln := range f.listeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			ports = append(ports, addr.Port)
+		}
+	}
+	return ports
+}
+
+// Stop listening and close all open connections
+func (f *tcpForwarder) Stop() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for _, ln := range f.listeners {
+		ln.Close()
+	}
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *tcpForwarder) serve(ln net.Listener, upstream string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			f.mu.Lock()
+			closed := f.closed
+			f.mu.Unlock()
+			if closed {
+				return
+			}
+			fmt.Printf("[*] warning: tcp accept failed for %s: %s\n", f.host, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go f.handle(conn, upstream)
+	}
+}
+
+// track an open connection, so it can be closed on Stop. Returns false if
+// already stopped.
+func (f *tcpForwarder) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+func (f *tcpForwarder) untrack(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, conn)
+}
+
+func (f *tcpForwarder) handle(conn net.Conn, upstream string) {
+	start := time.Now()
+	defer conn.Close()
+	if !f.track(conn) {
+		return
+	}
+	defer f.untrack(conn)
+
+	entry := func(msg string, a ...interface{}) *LogEntry {
+		return &LogEntry{
+			Time:       time.Now(),
+			Vhost:      f.host,
+			Proto:      "TCP",
+			Upstream:   upstream,
+			RemoteAddr: conn.RemoteAddr().String(),
+			Message:    fmt.Sprintf(msg, a...),
+		}
+	}
+
+	tlsVersion := ""
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(tcpDialTimeout))
+		if err := tc.Handshake(); err != nil {
+			f.lh.pushLog(f.host, entry("tcp tls handshake failed: %s", err))
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		tlsVersion = strings.ReplaceAll(tls.VersionName(tc.ConnectionState().Version), " ", "")
+	}
+
+	up, err := net.DialTimeout("tcp", upstream, tcpDialTimeout)
+	if err != nil {
+		f.lh.pushLog(f.host, entry("tcp connect to %s failed: %s", upstream, err))
+		return
+	}
+	defer up.Close()
+	if !f.track(up) {
+		return
+	}
+	defer f.untrack(up)
+
+	opened := entry("tcp open -> %s", upstream)
+	opened.TLS = tlsVersion
+	f.lh.pushLog(f.host, opened)
+
+	// pipe until both sides are done, passing along half-closes
+	var in int64
+	done := make(chan struct{})
+	go func() {
+		in, _ = io.Copy(up, conn)
+		closeWrite(up)
+		close(done)
+	}()
+	out, _ := io.Copy(conn, up)
+	closeWrite(conn)
+	<-done
+
+	closed := entry("tcp close -> %s (%d bytes in, %d bytes out)", upstream, in, out)
+	closed.TLS = tlsVersion
+	closed.BytesIn, closed.BytesOut = in, out
+	closed.Duration = time.Since(start)
+	f.lh.pushLog(f.host, closed)
+}
+
+// closeWrite signals EOF to the peer, if the conn supports it
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// serveTCPInfo is the HTTP handler for TCP vhosts, which explains where to
+// connect instead
+func serveTCPInfo(v *Vhost) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := &ErrorPage{
+			Kind:      ErrorNotFound,
+			Status:    http.StatusNotFound,
+			Message:   fmt.Sprintf("%s forwards TCP on port %s, not HTTP", v.Host, v.Options.TCP),
+			Host:      v.Host,
+			Upstream:  v.upstream(),
+			RequestID: r.Header.Get(HeaderRequestID),
+		}
+		page.Serve(w, r, v.opts().ErrorPages)
+	})
+}
+
+// tcpSummary for list output, e.g. "tcp :15432, tls"
+func (v *Vhost) tcpSummary() string {
+	if v.Options.TCP == "" {
+		return ""
+	}
+	s := "tcp :" + v.Options.TCP
+	if isTrue(v.Options.TCPTLS) {
+		s += ", tls"
+	}
+	if v.tcp == nil {
+		s += ", not listening"
+	}
+	return s
+}
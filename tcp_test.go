@@ -0,0 +1,161 @@
+package vproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startEcho server which writes back whatever it reads
+func startEcho() (net.Listener, int) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+// roundTrip a message over the conn, half-closing it to end the exchange
+func roundTrip(t *testing.T, conn net.Conn, msg string) string {
+	_, err := conn.Write([]byte(msg))
+	assert.Nil(t, err)
+	closeWrite(conn)
+	b, err := io.ReadAll(conn)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("5432")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{5432}, ports)
+	ports, err = parsePorts("7000-7002")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{7000, 7001, 7002}, ports)
+
+	for _, spec := range []string{"", "0", "abc", "7002-7000", "1-5000", "65536"} {
+		_, err = parsePorts(spec)
+		assert.NotNil(t, err, spec)
+	}
+	assert.Nil(t, VhostOptions{TCP: TCPAuto}.Validate())
+	assert.NotNil(t, VhostOptions{TCP: "5432", Dir: "."}.Validate())
+	on := true
+	assert.NotNil(t, VhostOptions{TCPTLS: &on}.Validate())
+}
+
+func TestTCPVhost(t *testing.T) {
+	reset()
+	echo, port := startEcho()
+	defer echo.Close()
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, false))
+	d := NewDaemon(lh, "127.0.0.1", 0, 0)
+	assert.Nil(t, d.SetTCPPorts("23100-23149"))
+
+	r := httptest.NewRecorder()
+	vhost := d.addVhostWithOptions(fmt.Sprintf("pg.local:%d", port), VhostOptions{TCP: TCPAuto}, r)
+	assert.NotNil(t, vhost)
+	assert.Contains(t, r.Body.String(), "forwarding tcp: :231")
+	tcpPort, err := strconv.Atoi(vhost.Options.TCP)
+	assert.Nil(t, err)
+	assert.True(t, tcpPort >= 23100 && tcpPort < 23150)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", roundTrip(t, conn, "hello"))
+	conn.Close()
+
+	// open and close are logged to the vhost
+	time.Sleep(50 * time.Millisecond)
+	logs := vhost.BufferedLogs()
+	assert.Equal(t, 2, len(logs))
+	assert.Equal(t, "TCP", logs[1].Proto)
+	assert.Equal(t, int64(5), logs[1].BytesIn)
+	assert.Equal(t, int64(5), logs[1].BytesOut)
+	assert.Contains(t, logs[1].Message, "tcp close")
+
+	// auto ports aren't reused
+	other := d.addVhostWithOptions(fmt.Sprintf("redis.local:%d", port), VhostOptions{TCP: TCPAuto}, httptest.NewRecorder())
+	assert.NotEqual(t, vhost.Options.TCP, other.Options.TCP)
+
+	var list bytes.Buffer
+	lh.DumpServers(&list)
+	assert.Contains(t, list.String(), fmt.Sprintf("pg.local -> 127.0.0.1:%d [tcp :%d]", port, tcpPort))
+
+	// HTTP requests get a hint instead
+	r = httptest.NewRecorder()
+	lh.ServeHTTP(r, httptest.NewRequest("GET", "http://pg.local/", nil))
+	assert.Equal(t, http.StatusNotFound, r.Code)
+	assert.Contains(t, r.Body.String(), fmt.Sprintf("forwards TCP on port %d", tcpPort))
+
+	// fixed port already in use
+	r = httptest.NewRecorder()
+	d.addVhostWithOptions(fmt.Sprintf("mysql.local:%d", port), VhostOptions{TCP: strconv.Itoa(tcpPort)}, r)
+	assert.Equal(t, http.StatusBadRequest, r.Code)
+	assert.Nil(t, lh.GetVhost("mysql.local"))
+
+	d.doRemoveVhost(vhost, httptest.NewRecorder())
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	assert.NotNil(t, err)
+	d.doRemoveVhost(other, httptest.NewRecorder())
+}
+
+func TestTCPTLS(t *testing.T) {
+	reset()
+	echo, port := startEcho()
+	defer echo.Close()
+
+	on := true
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, false))
+	vhost, err := CreateVhostWithOptions(fmt.Sprintf("pg.local:%d", port), true, VhostOptions{TCP: "0", TCPTLS: &on})
+	assert.NotNil(t, err) // port 0 is not a valid listen port
+
+	vhost, err = CreateVhostWithOptions(fmt.Sprintf("pg.local:%d", port), true, VhostOptions{TCP: TCPAuto, TCPTLS: &on})
+	assert.Nil(t, err)
+	defer vhost.Close()
+	lh.AddVhost(vhost)
+	vhost.tcp, err = startTCPForwarder(lh, vhost, "127.0.0.1", []int{0})
+	assert.Nil(t, err)
+
+	ca, err := loadCACert()
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	addr := fmt.Sprintf("127.0.0.1:%d", vhost.tcp.Ports()[0])
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "pg.local"})
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", roundTrip(t, conn, "secret"))
+	conn.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	logs := vhost.BufferedLogs()
+	assert.Equal(t, 2, len(logs))
+	assert.True(t, strings.HasPrefix(logs[0].TLS, "TLS"))
+
+	// TLS requires a cert
+	plain, err := CreateVhostWithOptions(fmt.Sprintf("plain.local:%d", port), false, VhostOptions{TCP: TCPAuto, TCPTLS: &on})
+	assert.Nil(t, err)
+	defer plain.Close()
+	_, err = startTCPForwarder(lh, plain, "127.0.0.1", []int{0})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,121 @@
+package vproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ExchangeTimings break down where the time for an exchange was spent, as
+// measured by the proxy transport
+type ExchangeTimings struct {
+	Blocked    time.Duration `json:"blocked_ns"` // until the final attempt started (incl. retries)
+	DNS        time.Duration `json:"dns_ns"`
+	Connect    time.Duration `json:"connect_ns"` // incl. TLS
+	TLS        time.Duration `json:"tls_ns"`
+	Send       time.Duration `json:"send_ns"`
+	Wait       time.Duration `json:"wait_ns"` // time to first byte
+	Receive    time.Duration `json:"receive_ns"`
+	Retries    int           `json:"retries,omitempty"`
+	ServerAddr string        `json:"server_addr,omitempty"`
+}
+
+type upstreamTraceKey struct{}
+
+// upstreamTrace records timestamps for the request to the upstream. Only the
+// final attempt is kept when a request is retried.
+type upstreamTrace struct {
+	mu         sync.Mutex
+	attempts   int
+	start      time.Time
+	dnsStart   time.Time
+	dnsDone    time.Time
+	connStart  time.Time
+	tlsStart   time.Time
+	tlsDone    time.Time
+	gotConn    time.Time
+	wrote      time.Time
+	firstByte  time.Time
+	serverAddr string
+}
+
+func withUpstreamTrace(ctx context.Context, t *upstreamTrace) context.Context {
+	return context.WithValue(ctx, upstreamTraceKey{}, t)
+}
+
+func upstreamTraceFrom(ctx context.Context) *upstreamTrace {
+	t, _ := ctx.Value(upstreamTraceKey{}).(*upstreamTrace)
+	return t
+}
+
+// attempt marks the start of a (new) round trip
+func (t *upstreamTrace) attempt() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts++
+	t.start = time.Now()
+	t.dnsStart, t.dnsDone, t.connStart = time.Time{}, time.Time{}, time.Time{}
+	t.tlsStart, t.tlsDone, t.gotConn, t.wrote, t.firstByte = time.Time{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	t.serverAddr = ""
+}
+
+func (t *upstreamTrace) set(ts *time.Time) func() {
+	return func() {
+		t.mu.Lock()
+		*ts = time.Now()
+		t.mu.Unlock()
+	}
+}
+
+func (t *upstreamTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.set(&t.dnsStart)() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.set(&t.dnsDone)() },
+		ConnectStart:      func(string, string) { t.set(&t.connStart)() },
+		TLSHandshakeStart: t.set(&t.tlsStart),
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.set(&t.tlsDone)() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.gotConn = time.Now()
+			t.serverAddr = info.Conn.RemoteAddr().String()
+			t.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.set(&t.wrote)() },
+		GotFirstResponseByte: t.set(&t.firstByte),
+	}
+}
+
+// timings relative to the start and end of serving the request
+func (t *upstreamTrace) timings(start time.Time, end time.Time) *ExchangeTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.attempts == 0 {
+		return nil
+	}
+	between := func(a, b time.Time) time.Duration {
+		if a.IsZero() || b.IsZero() || b.Before(a) {
+			return 0
+		}
+		return b.Sub(a)
+	}
+	sent := t.gotConn
+	if sent.IsZero() {
+		sent = t.start
+	}
+	return &ExchangeTimings{
+		Blocked:    between(start, t.start),
+		DNS:        between(t.dnsStart, t.dnsDone),
+		Connect:    between(t.connStart, t.gotConn),
+		TLS:        between(t.tlsStart, t.tlsDone),
+		Send:       between(sent, t.wrote),
+		Wait:       between(t.wrote, t.firstByte),
+		Receive:    between(t.firstByte, end),
+		Retries:    t.attempts - 1,
+		ServerAddr: t.serverAddr,
+	}
+}
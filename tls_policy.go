@@ -0,0 +1,117 @@
+package vproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TLSPolicy controls the TLS versions, ciphers and protocols offered for a
+// vhost. Empty values use Go's defaults.
+type TLSPolicy struct {
+	TLSMinVersion string   `json:"tls_min_version,omitempty"` // e.g., "1.2"
+	TLSMaxVersion string   `json:"tls_max_version,omitempty"` // e.g., "1.3"
+	TLSCiphers    []string `json:"tls_ciphers,omitempty"`     // TLS 1.0-1.2 cipher suite names
+	TLSCurves     []string `json:"tls_curves,omitempty"`      // e.g., X25519, P256
+	HTTP2         *bool    `json:"http2,omitempty"`           // offer h2 via ALPN (default: true)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	v = strings.TrimPrefix(strings.ToLower(v), "tls")
+	if id, ok := tlsVersions[strings.TrimSpace(v)]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version '%s' (expected one of 1.0, 1.1, 1.2, 1.3)", v)
+}
+
+func parseCipher(name string) (uint16, error) {
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if c.Name == name {
+			return c.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite '%s'", name)
+}
+
+func parseCurve(name string) (tls.CurveID, error) {
+	if id, ok := tlsCurves[strings.ToUpper(strings.ReplaceAll(name, "-", ""))]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("unknown curve '%s' (expected one of X25519, P256, P384, P521)", name)
+}
+
+// Validate the policy
+func (p TLSPolicy) Validate() error {
+	return p.apply(&tls.Config{})
+}
+
+// apply the policy to the given config
+func (p TLSPolicy) apply(cfg *tls.Config) error {
+	var err error
+	if p.TLSMinVersion != "" {
+		if cfg.MinVersion, err = parseTLSVersion(p.TLSMinVersion); err != nil {
+			return err
+		}
+	}
+	if p.TLSMaxVersion != "" {
+		if cfg.MaxVersion, err = parseTLSVersion(p.TLSMaxVersion); err != nil {
+			return err
+		}
+	}
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return fmt.Errorf("TLS min version %s is greater than max version %s", p.TLSMinVersion, p.TLSMaxVersion)
+	}
+
+	if len(p.TLSCiphers) > 0 {
+		// only applies to TLS 1.0-1.2; 1.3 suites are not configurable
+		cfg.CipherSuites = nil
+		for _, name := range p.TLSCiphers {
+			id, err := parseCipher(name)
+			if err != nil {
+				return err
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	if len(p.TLSCurves) > 0 {
+		cfg.CurvePreferences = nil
+		for _, name := range p.TLSCurves {
+			id, err := parseCurve(name)
+			if err != nil {
+				return err
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+
+	if p.HTTP2 != nil && !*p.HTTP2 {
+		cfg.NextProtos = []string{"http/1.1"}
+	} else {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return nil
+}
+
+// tlsVersionName of the request for logging, e.g. "TLS1.3"
+func tlsVersionName(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return strings.ReplaceAll(tls.VersionName(r.TLS.Version), " ", "")
+}
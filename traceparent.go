@@ -0,0 +1,79 @@
+package vproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Headers used for request correlation
+const (
+	HeaderRequestID   = "X-Request-ID"
+	HeaderTraceparent = "Traceparent"
+)
+
+// traceparent: version-traceid-parentid-flags
+var reTraceparent = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceContext is the W3C trace context for a single proxied request
+type traceContext struct {
+	TraceID  string
+	ParentID string // span ID of the caller, if any
+	SpanID   string // span ID of the proxy
+	Flags    string
+}
+
+// parseTraceparent returns nil if the header is missing or invalid
+func parseTraceparent(h string) *traceContext {
+	m := reTraceparent.FindStringSubmatch(strings.TrimSpace(strings.ToLower(h)))
+	if m == nil || m[1] == "ff" || strings.Trim(m[2], "0") == "" || strings.Trim(m[3], "0") == "" {
+		return nil
+	}
+	return &traceContext{TraceID: m[2], ParentID: m[3], Flags: m[4]}
+}
+
+func (tc *traceContext) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%s", tc.TraceID, tc.SpanID, tc.Flags)
+}
+
+// startTrace ensures the request carries an X-Request-ID and traceparent,
+// preserving any incoming values. When spans are exported, the traceparent
+// sent upstream is rewritten so that the proxy's span becomes the parent.
+func startTrace(r *http.Request, exporting bool) (requestID string, tc *traceContext) {
+	requestID = r.Header.Get(HeaderRequestID)
+	if requestID == "" {
+		requestID = randomHex(8)
+		r.Header.Set(HeaderRequestID, requestID)
+	}
+
+	tc = parseTraceparent(r.Header.Get(HeaderTraceparent))
+	if tc == nil {
+		tc = &traceContext{TraceID: randomHex(16), Flags: "01"}
+		tc.SpanID = randomHex(8)
+		r.Header.Set(HeaderTraceparent, tc.traceparent())
+	} else if exporting {
+		tc.SpanID = randomHex(8)
+		r.Header.Set(HeaderTraceparent, tc.traceparent())
+	} else {
+		tc.SpanID = tc.ParentID // passed through untouched
+		tc.ParentID = ""
+	}
+	return requestID, tc
+}
+
+// ensureTraceHeaders is used by the proxy director for requests which did not
+// pass through LoggedHandler
+func ensureTraceHeaders(r *http.Request) {
+	if r.Header.Get(HeaderRequestID) == "" || parseTraceparent(r.Header.Get(HeaderTraceparent)) == nil {
+		startTrace(r, false)
+	}
+}
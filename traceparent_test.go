@@ -0,0 +1,44 @@
+package vproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDAndTraceparent(t *testing.T) {
+	reset()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Header.Get(HeaderRequestID), r.Header.Get(HeaderTraceparent))
+	}))
+	defer upstream.Close()
+	port := strings.TrimPrefix(upstream.URL, "http://127.0.0.1:")
+
+	lh := NewLoggedHandler(CreateVhostMux([]string{}, true))
+	vhost, err := CreateVhost("trace.local:"+port, false)
+	assert.Nil(t, err)
+	lh.AddVhost(vhost)
+
+	// generated when absent
+	w := httptest.NewRecorder()
+	lh.ServeHTTP(w, httptest.NewRequest("GET", "http://trace.local/", nil))
+	parts := strings.Split(w.Body.String(), " ")
+	assert.Equal(t, 16, len(parts[0]))
+	tc := parseTraceparent(parts[1])
+	assert.NotNil(t, tc)
+	ex := vhost.exchanges.List()[0]
+	assert.Equal(t, parts[0], ex.RequestID)
+
+	// preserved when present
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "http://trace.local/", nil)
+	req.Header.Set(HeaderRequestID, "abc-123")
+	req.Header.Set(HeaderTraceparent, parent)
+	w = httptest.NewRecorder()
+	lh.ServeHTTP(w, req)
+	assert.Equal(t, "abc-123 "+parent, w.Body.String())
+}
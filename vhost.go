@@ -6,14 +6,21 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"reflect"
+	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gammazero/deque"
 	"github.com/txn2/txeh"
 )
 
+// valid vhost names, which are also used in file names (e.g., for logs)
+var reHostname = regexp.MustCompile(`^[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*$`)
+
 // Vhost represents a single backend service
 type Vhost struct {
 	Host string `json:"host"` // virtual host name
@@ -25,13 +32,209 @@ type Vhost struct {
 	Cert    string       // TLS Certificate
 	Key     string       // TLS Private Key
 
-	logRing   *deque.Deque[string] `json:"-"`
-	logChan   LogListener          `json:"-"`
-	listeners []LogListener        `json:"-"`
-	closed    bool                 `json:"-"`
+	Options VhostOptions `json:"options"`
+
+	exchanges *exchangeStore          `json:"-"`
+	logSize   int                     `json:"-"`
+	logRing   *deque.Deque[*LogEntry] `json:"-"`
+	logFile   *logFile                `json:"-"`
+	health    *healthChecker          `json:"-"`
+	tcp       *tcpForwarder           `json:"-"`
+	logChan   LogListener             `json:"-"` // entries for logFile
+	listeners []LogListener           `json:"-"`
+	closed    bool                    `json:"-"`
+
+	mu sync.Mutex // guards logRing, listeners and closed
 }
 
-type LogListener chan string
+type LogListener chan *LogEntry
+
+// VhostOptions are optional per-vhost settings. They are passed along by the
+// client when registering a vhost and persisted with it.
+type VhostOptions struct {
+	// Client cert (mTLS) mode: "optional" or "require" (default: disabled)
+	ClientAuth string `json:"client_auth,omitempty"`
+	// PEM file with CA(s) trusted to sign client certs (default: local CA)
+	ClientCA string `json:"client_ca,omitempty"`
+
+	// Serve files from this directory instead of proxying to an upstream
+	Dir        string `json:"dir,omitempty"`
+	SPA        *bool  `json:"spa,omitempty"`         // serve /index.html for unknown paths
+	DirListing *bool  `json:"dir_listing,omitempty"` // default: true
+
+	// Redirect all requests to this URL, preserving the path and query
+	Redirect     string `json:"redirect,omitempty"`
+	RedirectCode int    `json:"redirect_code,omitempty"` // 301, 302 (default), 307 or 308
+
+	// Serve requests with another vhost's handler and cert
+	AliasOf string `json:"alias_of,omitempty"`
+
+	// Forward raw TCP from this port, port range (e.g. "7000-7002") or "auto"
+	// to the upstream port(s), instead of serving HTTP
+	TCP    string `json:"tcp,omitempty"`
+	TCPTLS *bool  `json:"tcp_tls,omitempty"` // terminate TLS using the vhost's cert
+
+	TLSPolicy
+	RetryPolicy
+	HealthPolicy
+	ForwardedPolicy
+	CompressionPolicy
+
+	// Redirect plain HTTP requests to HTTPS
+	RedirectHTTPS *bool `json:"redirect_https,omitempty"`
+	// Send a Strict-Transport-Security header on HTTPS responses
+	HSTS       *bool `json:"hsts,omitempty"`
+	HSTSMaxAge int   `json:"hsts_max_age,omitempty"` // seconds (default: 1 hour)
+
+	// Capture full requests and responses for inspection. Requests are
+	// always retained (for replay), but response bodies only when enabled.
+	Capture          *bool `json:"capture,omitempty"`
+	CaptureSize      int   `json:"capture_size,omitempty"`       // number of exchanges to keep
+	CaptureBodyLimit int   `json:"capture_body_limit,omitempty"` // max bytes kept per body
+
+	// Header rules applied to requests sent upstream and responses sent back,
+	// e.g. "X-Auth: token" (set), "+Via: vproxy" (add) or "-Server" (remove)
+	RequestHeaders  []string `json:"request_headers,omitempty"`
+	ResponseHeaders []string `json:"response_headers,omitempty"`
+
+	// Rewrite upstream URLs in Location, Content-Location and Refresh headers,
+	// and cookie domains, to the vhost (default: true)
+	RewriteResponses *bool `json:"rewrite_responses,omitempty"`
+
+	// Strip caching headers from responses (and conditional headers from
+	// requests) so that browsers never use stale assets
+	NoCache *bool `json:"no_cache,omitempty"`
+
+	// Directory of error page templates (e.g., upstream_down.html)
+	ErrorPages string `json:"error_pages,omitempty"`
+
+	// Continuously append exchanges to a HAR (or .ndjson) file, by name, in
+	// HARPath
+	HARFile string `json:"har_file,omitempty"`
+
+	// Number of log entries kept in memory for `tail` (default: 100)
+	LogHistory int `json:"log_history,omitempty"`
+	// Write access logs to rotating files under CertPath()/logs
+	LogFiles    *bool `json:"log_files,omitempty"`
+	LogMaxSize  int   `json:"log_max_size,omitempty"`  // MB per file (default: 10)
+	LogMaxFiles int   `json:"log_max_files,omitempty"` // rotated files to keep (default: 5)
+}
+
+// Default number of log entries kept in memory per vhost
+const defaultLogHistory = 100
+
+// DefaultVhostOptions are used for any option which a vhost does not set
+// itself. Set from the daemon config.
+var DefaultVhostOptions VhostOptions
+
+// withDefaults returns a copy of the options with any unset (zero) fields
+// filled in from the given defaults
+func (o VhostOptions) withDefaults(defaults VhostOptions) VhostOptions {
+	mergeZero(reflect.ValueOf(&o).Elem(), reflect.ValueOf(defaults))
+	return o
+}
+
+func mergeZero(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		f := dst.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		if f.Kind() == reflect.Struct {
+			mergeZero(f, src.Field(i))
+		} else if f.IsZero() {
+			f.Set(src.Field(i))
+		}
+	}
+}
+
+// Validate the options
+func (o VhostOptions) Validate() error {
+	if err := o.TLSPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := o.RetryPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := o.HealthPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := o.ForwardedPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := o.CompressionPolicy.Validate(); err != nil {
+		return err
+	}
+	if _, err := parseHeaderRules(o.RequestHeaders); err != nil {
+		return err
+	}
+	if _, err := parseHeaderRules(o.ResponseHeaders); err != nil {
+		return err
+	}
+
+	switch o.ClientAuth {
+	case "", "optional", "require":
+	default:
+		return fmt.Errorf("invalid client auth mode '%s' (expected 'optional' or 'require')", o.ClientAuth)
+	}
+	kinds := 0
+	for _, v := range []string{o.Dir, o.Redirect, o.AliasOf, o.TCP} {
+		if v != "" {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return fmt.Errorf("only one of a dir, redirect, alias or tcp port may be given")
+	}
+	if o.Dir != "" {
+		if err := validateDir(o.Dir); err != nil {
+			return err
+		}
+	}
+	if o.ErrorPages != "" {
+		if err := checkDir("error pages dir", o.ErrorPages); err != nil {
+			return err
+		}
+	}
+	if o.Redirect != "" {
+		if err := validateRedirect(o.Redirect, o.RedirectCode); err != nil {
+			return err
+		}
+	} else if o.RedirectCode != 0 {
+		return fmt.Errorf("redirect code given without a redirect URL")
+	}
+	if o.AliasOf != "" && !reHostname.MatchString(o.AliasOf) {
+		return fmt.Errorf("invalid alias target '%s' (expected a hostname)", o.AliasOf)
+	}
+	if err := validateHARFile(o.HARFile); err != nil {
+		return err
+	}
+	if o.TCP != "" {
+		if err := validateTCP(o.TCP); err != nil {
+			return err
+		}
+	} else if isTrue(o.TCPTLS) {
+		return fmt.Errorf("tcp tls given without a tcp port")
+	}
+	if o.ClientCA != "" && o.ClientAuth == "" {
+		return fmt.Errorf("client CA given but client auth is not enabled")
+	}
+	if o.HSTSMaxAge < 0 {
+		return fmt.Errorf("invalid HSTS max age: %d", o.HSTSMaxAge)
+	}
+	if o.CaptureSize < 0 || o.CaptureBodyLimit < 0 {
+		return fmt.Errorf("invalid capture size or body limit")
+	}
+	if o.LogHistory < 0 || o.LogMaxSize < 0 || o.LogMaxFiles < 0 {
+		return fmt.Errorf("invalid log history or log file size")
+	}
+	return nil
+}
+
+// hasUpstream returns false for static, redirect and alias vhosts
+func (o VhostOptions) hasUpstream() bool {
+	return o.Dir == "" && o.Redirect == "" && o.AliasOf == ""
+}
 
 // VhostMux is an http.Handler whose ServeHTTP forwards the request to
 // backend Servers according to the incoming request URL
@@ -44,10 +247,22 @@ func (v *VhostMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	host := getHostName(r.Host)
 	vhost := v.Servers[host]
+	missing := host
+	if vhost != nil && vhost.Options.AliasOf != "" {
+		// aliases are served by their target
+		missing = vhost.Options.AliasOf
+		vhost = v.Servers[missing]
+	}
 	if vhost == nil {
-		log.Printf("Host Not Found: `%s`", host)
-		w.WriteHeader(404)
-		fmt.Fprintln(w, "host not found:", host)
+		log.Printf("Host Not Found: `%s`", missing)
+		page := &ErrorPage{
+			Kind:      ErrorUnknownHost,
+			Status:    http.StatusNotFound,
+			Message:   "host not found: " + missing,
+			Host:      host,
+			RequestID: r.Header.Get(HeaderRequestID),
+		}
+		page.Serve(w, r, DefaultVhostOptions.ErrorPages)
 		return
 	}
 
@@ -55,11 +270,23 @@ func (v *VhostMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if val := recover(); val != nil {
 			log.Printf("Error proxying request `%s` to `%s`: %v", originalURL, r.URL, val)
 			log.Printf("%s", debug.Stack())
-			w.WriteHeader(http.StatusServiceUnavailable)
-			fmt.Fprintf(w, "Error proxying request `%s` to `%s`: %v", originalURL, r.URL, val)
+			page := &ErrorPage{
+				Kind:      ErrorPanic,
+				Status:    http.StatusServiceUnavailable,
+				Message:   fmt.Sprintf("Error proxying request `%s` to `%s`: %v", originalURL, r.URL, val),
+				Host:      host,
+				Upstream:  vhost.upstream(),
+				RequestID: r.Header.Get(HeaderRequestID),
+			}
+			page.Serve(w, r, vhost.opts().ErrorPages)
 		}
 	}()
 
+	if vhost.health.isDown() {
+		serveUpstreamDown(w, r, vhost)
+		return
+	}
+
 	// handle it
 	vhost.Handler.ServeHTTP(w, r)
 }
@@ -75,7 +302,14 @@ func (v *VhostMux) DumpServers(w io.Writer) {
 		fmt.Fprintf(w, "%d vhosts:\n", c)
 	}
 	for _, v := range v.Servers {
-		fmt.Fprintf(w, "%s -> %s:%d\n", v.Host, v.ServiceHost, v.ServicePort)
+		line := fmt.Sprintf("%s -> %s", v.Host, v.upstream())
+		if tcp := v.tcpSummary(); tcp != "" {
+			line += " [" + tcp + "]"
+		}
+		if health := v.Health(); health.State != "" {
+			line += fmt.Sprintf(" (%s)", health)
+		}
+		fmt.Fprintln(w, line)
 	}
 }
 
@@ -98,16 +332,36 @@ func CreateVhostMux(bindings []string, useTLS bool) *VhostMux {
 
 // CreateVhost for the host:port pair, optionally with a TLS cert
 func CreateVhost(input string, useTLS bool) (*Vhost, error) {
+	return CreateVhostWithOptions(input, useTLS, VhostOptions{})
+}
+
+// CreateVhostWithOptions for the host:port pair, optionally with a TLS cert
+func CreateVhostWithOptions(input string, useTLS bool, opts VhostOptions) (*Vhost, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
 	s := strings.Split(input, ":")
-	if len(s) < 2 {
+	if len(s) < 2 && opts.hasUpstream() {
 		// invalid binding
 		return nil, fmt.Errorf("error: invalid binding '%s'", input)
 	}
 
+	// static, redirect and alias vhosts have no upstream port
 	hostname := s[0]
-	targetPort, err := strconv.Atoi(s[1])
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse target port: %s", err)
+	if !reHostname.MatchString(hostname) {
+		return nil, fmt.Errorf("error: invalid hostname '%s'", hostname)
+	}
+	if hostname == opts.AliasOf {
+		return nil, fmt.Errorf("vhost %s can't be an alias of itself", hostname)
+	}
+	targetPort := 0
+	var err error
+	if len(s) >= 2 || opts.hasUpstream() {
+		targetPort, err = strconv.Atoi(s[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse target port: %s", err)
+		}
 	}
 	targetHost := "127.0.0.1"
 
@@ -115,6 +369,7 @@ func CreateVhost(input string, useTLS bool) (*Vhost, error) {
 		Host:        hostname,
 		ServiceHost: targetHost,
 		ServicePort: targetPort,
+		Options:     opts,
 	}
 
 	if useTLS {
@@ -129,24 +384,94 @@ func CreateVhost(input string, useTLS bool) (*Vhost, error) {
 	return vhost, nil
 }
 
+// isTrue returns true if the given optional flag is set and true
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// captureSize returns the number of exchanges to retain
+func (v *Vhost) captureSize() int {
+	opts := v.opts()
+	if opts.CaptureSize > 0 {
+		return opts.CaptureSize
+	} else if isTrue(opts.Capture) {
+		return defaultCaptureSize
+	}
+	return defaultRetainSize
+}
+
+// captureBodyLimit returns the max body size to retain per request/response
+func (v *Vhost) captureBodyLimit() int {
+	opts := v.opts()
+	if opts.CaptureBodyLimit > 0 {
+		return opts.CaptureBodyLimit
+	} else if isTrue(opts.Capture) {
+		return defaultCaptureBodyLimit
+	}
+	return defaultRetainBodyLimit
+}
+
+// opts returns the vhost's options, merged with the daemon defaults
+func (v *Vhost) opts() VhostOptions {
+	return v.Options.withDefaults(DefaultVhostOptions)
+}
+
 func (v *Vhost) Init() {
 	targetURL := url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", v.ServiceHost, v.ServicePort)}
-	v.Handler = CreateProxy(targetURL, v.Host)
-	v.logChan = make(LogListener, 10)
-	// set fixed capacity at 16
-	v.logRing = &deque.Deque[string]{}
-	v.logRing.Grow(16)
-	v.logRing.SetBaseCap(16)
-	go v.populateLogBuffer()
+	opts := v.opts()
+	switch {
+	case opts.Dir != "":
+		v.Handler = newStaticHandler(opts.Dir, opts)
+	case opts.Redirect != "":
+		v.Handler = newRedirectHandler(opts.Redirect, opts.RedirectCode)
+	case opts.AliasOf != "":
+		// resolved by VhostMux
+	case opts.TCP != "":
+		v.Handler = serveTCPInfo(v)
+	default:
+		v.Handler = CreateProxyWithOptions(targetURL, v.Host, opts)
+	}
+	v.exchanges = newExchangeStore(v.captureSize())
+	v.logSize = opts.LogHistory
+	if v.logSize == 0 {
+		v.logSize = defaultLogHistory
+	}
+	v.logRing = &deque.Deque[*LogEntry]{}
+	v.logRing.Grow(v.logSize)
+	v.logRing.SetBaseCap(v.logSize)
+	if isTrue(opts.LogFiles) {
+		v.logFile = newLogFile(v.Host, opts.LogMaxSize, opts.LogMaxFiles)
+		v.logChan = make(LogListener, 10)
+		go v.writeLogFile()
+	}
+	if opts.HealthPolicy.enabled() && opts.hasUpstream() {
+		v.health = newHealthChecker(v.Host, v.upstream(), opts.HealthPolicy)
+		go v.health.run()
+	}
+}
+
+// Health of the upstream; empty if health checks are disabled
+func (v *Vhost) Health() HealthStatus {
+	return v.health.Status()
 }
 
 func (v *Vhost) NewLogListener() LogListener {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	logChan := make(LogListener, 100)
 	v.listeners = append(v.listeners, logChan)
 	return logChan
 }
 
+func (v *Vhost) listenerCount() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.listeners)
+}
+
 func (v *Vhost) RemoveLogListener(logChan LogListener) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	index := 0
 	for _, i := range v.listeners {
 		if i != logChan {
@@ -157,22 +482,23 @@ func (v *Vhost) RemoveLogListener(logChan LogListener) {
 	v.listeners = v.listeners[:index]
 }
 
-func (v *Vhost) BufferAsString() string {
-	if v.logRing.Len() == 0 {
-		return ""
-	}
-	buff := ""
+// BufferedLogs returns the most recent log entries
+func (v *Vhost) BufferedLogs() []*LogEntry {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entries := []*LogEntry{}
 	for i := 0; i < v.logRing.Len(); i++ {
-		s := v.logRing.At(i)
-		if s != "" {
-			buff += s + "\n"
+		if e := v.logRing.At(i); e != nil {
+			entries = append(entries, e)
 		}
 	}
-	return buff
+	return entries
 }
 
 func (v *Vhost) Close() {
+	v.mu.Lock()
 	if v.closed {
+		v.mu.Unlock()
 		return
 	}
 	v.closed = true
@@ -182,32 +508,82 @@ func (v *Vhost) Close() {
 	if v.logRing != nil {
 		v.logRing.Clear()
 	}
+	v.mu.Unlock()
+
+	// may push final logs (e.g. tcp close), which are dropped
+	v.health.Stop()
+	v.tcp.Stop()
+}
+
+// isClosed returns true once the vhost has been removed
+func (v *Vhost) isClosed() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.closed
 }
 
-func (v *Vhost) PushLog(msg string) {
+// PushLog to the buffer, log file and listeners. A no-op once closed.
+func (v *Vhost) PushLog(entry *LogEntry) {
+	v.mu.Lock()
 	if v.closed {
+		v.mu.Unlock()
 		return
 	}
-	v.logChan <- msg // push to buffer
-	for _, logChan := range v.listeners {
+	if v.logRing.Len() >= v.logSize {
+		v.logRing.PopFront()
+	}
+	v.logRing.PushBack(entry)
+	if v.logChan != nil {
+		v.logChan <- entry
+	}
+	listeners := append([]LogListener{}, v.listeners...)
+	v.mu.Unlock()
+
+	for _, logChan := range listeners {
 		// push to client listeners
-		logChan <- msg
+		logChan <- entry
 	}
 }
 
-func (v *Vhost) populateLogBuffer() {
-	for line := range v.logChan {
-		if v.logRing.Len() < 10 {
-			v.logRing.PushBack(line)
-		} else {
-			v.logRing.Rotate(1)
-			v.logRing.Set(9, line)
+func (v *Vhost) writeLogFile() {
+	for entry := range v.logChan {
+		if err := v.logFile.Write(entry); err != nil {
+			fmt.Printf("[*] warning: failed to write log file for %s: %s\n", v.Host, err)
 		}
 	}
+	v.logFile.Close()
 }
 
-func (v Vhost) String() string {
-	return fmt.Sprintf("%s -> %s:%d", v.Host, v.ServiceHost, v.ServicePort)
+// LogsSince returns the log entries at or after the given time, read from the
+// on-disk logs if enabled, or else from the in-memory history
+func (v *Vhost) LogsSince(since time.Time) ([]*LogEntry, error) {
+	if v.logFile != nil {
+		return v.logFile.Since(since)
+	}
+	entries := []*LogEntry{}
+	for _, e := range v.BufferedLogs() {
+		if !e.Time.Before(since) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (v *Vhost) String() string {
+	return fmt.Sprintf("%s -> %s", v.Host, v.upstream())
+}
+
+// upstream address, as host:port, or the dir, redirect URL or alias target
+func (v *Vhost) upstream() string {
+	switch {
+	case v.Options.Dir != "":
+		return v.Options.Dir
+	case v.Options.Redirect != "":
+		return v.Options.Redirect
+	case v.Options.AliasOf != "":
+		return v.Options.AliasOf
+	}
+	return fmt.Sprintf("%s:%d", v.ServiceHost, v.ServicePort)
 }
 
 // Map given host to 127.0.0.1 in system hosts file (usually /etc/hosts)
@@ -217,6 +593,13 @@ func addToHosts(host string) error {
 		return err
 	}
 
+	if found, addr, _ := hosts.HostAddressLookup(host, txeh.IPFamilyV4); found && addr == "127.0.0.1" {
+		return nil // already mapped
+	}
 	hosts.AddHost("127.0.0.1", host)
-	return hosts.Save()
+	if err := hosts.Save(); err != nil {
+		return err
+	}
+	events.publish(Event{Type: EventHostsUpdated, Host: host})
+	return nil
 }